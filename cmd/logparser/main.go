@@ -4,8 +4,10 @@ package main
 import (
 	"bufio"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
@@ -14,6 +16,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/luccadibe/knativeBenchmark/pkg/latency"
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -21,6 +25,7 @@ type config struct {
 	dbPath     string
 	logDir     string
 	timeWindow time.Duration
+	mergeHdr   string
 }
 
 type experimentInfo struct {
@@ -28,6 +33,13 @@ type experimentInfo struct {
 	language  string
 	scenario  string
 	params    map[string]int
+	// The rest is only known from the run manifest
+	runID       string
+	name        string
+	description string
+	tags        []string
+	// extra holds every experiment parameter and label, for the experiment_params table
+	extra map[string]string
 }
 
 type request struct {
@@ -41,13 +53,25 @@ type request struct {
 	connect      float64
 	tls          float64
 	errorMessage string
+	errorClass   string
 	target       string
+	intendedTime time.Time
+	sendTime     time.Time
+	phase        string
+	protocol     string
+	grpcStatus   string
+	outcome      string
+	errorKind    string
+	// probe is set for cold start probes
+	probe *store.Probe
 }
 
 type processingStats struct {
 	filesProcessed      int
 	experimentsInserted int
 	requestsInserted    int
+	// emptyRuns are the logs of runs without any requests
+	emptyRuns []string
 }
 
 var knownLanguages = map[string]bool{
@@ -72,6 +96,13 @@ var (
 
 func main() {
 	cfg := parseFlags()
+	if cfg.mergeHdr != "" {
+		if err := mergeHistograms(cfg); err != nil {
+			log.Fatalf("Error merging histograms: %v", err)
+		}
+		return
+	}
+
 	db := initDB(cfg.dbPath)
 	defer db.Close()
 
@@ -82,6 +113,9 @@ func main() {
 
 	log.Printf("Processing complete. Files: %d, Experiments: %d, Requests: %d",
 		stats.filesProcessed, stats.experimentsInserted, stats.requestsInserted)
+	if len(stats.emptyRuns) > 0 {
+		log.Fatalf("No requests found for %d runs: %s", len(stats.emptyRuns), strings.Join(stats.emptyRuns, ", "))
+	}
 }
 
 func parseFlags() config {
@@ -89,6 +123,7 @@ func parseFlags() config {
 	flag.StringVar(&c.dbPath, "db", "benchmark.db", "SQLite database path")
 	flag.StringVar(&c.logDir, "logs", "./logs", "Log directory path")
 	timeWindow := flag.Int("hours", 24, "Processing time window in hours")
+	flag.StringVar(&c.mergeHdr, "merge-hdr", "", "Merge the latency histograms (.hlog) of all runs in the time window into this file and print their percentiles")
 	flag.Parse()
 
 	c.timeWindow = time.Duration(*timeWindow) * time.Hour
@@ -101,42 +136,7 @@ func initDB(dbPath string) *sql.DB {
 		log.Fatal(err)
 	}
 
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS experiments (
-            id INTEGER PRIMARY KEY,
-            timestamp DATETIME NOT NULL,
-            language TEXT NOT NULL,
-            scenario TEXT NOT NULL,
-            concurrency INTEGER,
-            rps INTEGER,
-            requests_per_second INTEGER,
-            duration TEXT,
-            max_idle_conns INTEGER,
-            max_idle_conns_per_host INTEGER,
-            idle_conn_timeout TEXT,
-            timeout TEXT,
-            triggers INTEGER,
-			workers INTEGER
-        );
-
-		CREATE TABLE IF NOT EXISTS requests (
-            id INTEGER PRIMARY KEY,
-            experiment_id INTEGER NOT NULL,
-            timestamp DATETIME NOT NULL,
-            status INTEGER NOT NULL,
-            ttfb REAL NOT NULL,
-            total_time REAL NOT NULL,
-            is_cold BOOLEAN NOT NULL,
-            dns_time REAL NOT NULL,
-            connect_time REAL NOT NULL,
-            tls_time REAL NOT NULL,
-            error_message TEXT,
-			event_id TEXT,
-			target TEXT,
-            FOREIGN KEY(experiment_id) REFERENCES experiments(id)
-        );
-	`)
-	if err != nil {
+	if err := store.InitSQLite(db); err != nil {
 		log.Fatal(err)
 	}
 	return db
@@ -156,8 +156,17 @@ func processLogs(db *sql.DB, cfg config) (*processingStats, error) {
 			continue
 		}
 
+		filePath := filepath.Join(cfg.logDir, entry.Name())
 		expInfo, err := parseFilename(entry.Name())
-		if err != nil {
+		manifest, manifestErr := store.ReadManifest(store.ManifestPath(filePath))
+		switch {
+		case manifestErr == nil:
+			// The manifest is authoritative, the file name only fills in what it lacks
+			expInfo = manifestInfo(manifest, expInfo)
+		case !errors.Is(manifestErr, fs.ErrNotExist):
+			log.Printf("Error reading manifest of %q: %v", entry.Name(), manifestErr)
+			continue
+		case err != nil:
 			log.Printf("Skipping invalid filename %q: %v", entry.Name(), err)
 			continue
 		}
@@ -165,14 +174,47 @@ func processLogs(db *sql.DB, cfg config) (*processingStats, error) {
 		if expInfo.timestamp.Before(cutoff) {
 			continue
 		}
+		if manifest != nil {
+			stored, err := storedRun(db, manifest)
+			if err != nil {
+				log.Printf("Error looking up run %s: %v", manifest.RunID, err)
+				continue
+			}
+			if stored {
+				log.Printf("Skipping %q, its results are already in a database", entry.Name())
+				continue
+			}
+		}
 
-		filePath := filepath.Join(cfg.logDir, entry.Name())
 		config, requests, err := processFile(filePath)
 		log.Printf("File processed: %s", filePath)
 		if err != nil {
 			log.Printf("Error processing %q: %v", entry.Name(), err)
 			continue
 		}
+		if manifest != nil {
+			config = manifest.RateColumns()
+		}
+
+		// Newer runs write their requests to a result file instead of the log
+		resultsPath, err := store.ResultFile(strings.TrimSuffix(filePath, ".log"))
+		if err != nil {
+			log.Printf("Error looking for the results of %q: %v", entry.Name(), err)
+			continue
+		}
+		if resultsPath != "" {
+			requests, err = readResults(resultsPath)
+			if err != nil {
+				log.Printf("Error reading results %q: %v", resultsPath, err)
+				continue
+			}
+		}
+		// A run without requests in its log or a result file is not inserted, its results are missing
+		if len(requests) == 0 {
+			log.Printf("Error: %q has no requests in its log or a jsonl, csv or parquet result file, not inserting it", entry.Name())
+			stats.emptyRuns = append(stats.emptyRuns, entry.Name())
+			continue
+		}
 
 		expID, err := insertExperiment(db, expInfo, config)
 		if err != nil {
@@ -180,11 +222,15 @@ func processLogs(db *sql.DB, cfg config) (*processingStats, error) {
 			continue
 		}
 
-		if len(requests) > 0 {
-			err = insertRequests(db, expID, requests)
-			if err != nil {
-				log.Printf("Error inserting requests: %v", err)
-				continue
+		if err := insertRequests(db, expID, requests); err != nil {
+			log.Printf("Error inserting requests: %v", err)
+			continue
+		}
+
+		histogramPath := strings.TrimSuffix(filePath, ".log") + ".hlog"
+		if _, err := os.Stat(histogramPath); err == nil {
+			if err := insertPercentiles(db, expID, histogramPath); err != nil {
+				log.Printf("Error inserting latency percentiles: %v", err)
 			}
 		}
 
@@ -281,10 +327,72 @@ func parseFilename(filename string) (*experimentInfo, error) {
 	return nil, fmt.Errorf("unrecognized filename format")
 }
 
+// manifestParams are the parameters of a run manifest that also have their own experiments column
+var manifestParams = []string{"concurrency", "rps", "triggers", "workers"}
+
+// manifestInfo takes the experiment metadata from a run manifest: its
+// experiment section, overridden by its labels. Both override what was parsed
+// from the file name, fromName may be nil.
+func manifestInfo(m *store.Manifest, fromName *experimentInfo) *experimentInfo {
+	info := &experimentInfo{params: make(map[string]int)}
+	if fromName != nil {
+		*info = *fromName
+	}
+	info.timestamp = m.Start.UTC()
+	info.runID = m.RunID
+	info.name = m.Experiment.Name
+	info.description = m.Experiment.Description
+	info.tags = m.Experiment.Tags
+	if m.Experiment.Scenario != "" {
+		info.scenario = m.Experiment.Scenario
+	}
+
+	info.extra = make(map[string]string)
+	for k, v := range m.Experiment.Params {
+		info.extra[k] = v
+	}
+	for k, v := range m.Labels {
+		info.extra[k] = v
+	}
+	if v, ok := info.extra["scenario"]; ok {
+		info.scenario = v
+	}
+	if v, ok := info.extra["language"]; ok {
+		info.language = v
+	}
+	for _, param := range manifestParams {
+		if v, ok := info.extra[param]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				log.Printf("Ignoring parameter %s=%q of run %s: %v", param, v, m.RunID, err)
+				continue
+			}
+			info.params[param] = n
+		}
+	}
+	return info
+}
+
+// storedRun reports whether the run of m does not need to be inserted: it is
+// already in db, or it wrote its results with the SQLite sink, which inserts
+// its own experiment. Runs before the sink recorded the run ID are only found by the latter.
+func storedRun(db *sql.DB, m *store.Manifest) (bool, error) {
+	if s, ok := m.Config["store"].(map[string]interface{}); ok && s["sink"] == store.SinkSQLite {
+		return true, nil
+	}
+	if m.RunID == "" {
+		return false, nil
+	}
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM experiments WHERE run_id = ?`, m.RunID).Scan(&n)
+	return n > 0, err
+}
+
 func processFile(path string) (map[string]interface{}, []request, error) {
 	log.Printf("Reading file: %s", path)
 
-	file, err := os.Open(path)
+	// Rotated logs are read as one file, see store.OpenSegments
+	file, err := store.OpenSegments(path)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -307,6 +415,7 @@ func processFile(path string) (map[string]interface{}, []request, error) {
 	// Process remaining lines
 	for scanner.Scan() {
 		line := scanner.Text()
+		// Runs before result files logged every request, see readResults for newer runs
 		if strings.Contains(line, `msg=Success`) || strings.Contains(line, `msg=Failed`) {
 			req, err := parseRequest(line)
 			if err == nil {
@@ -322,6 +431,42 @@ func processFile(path string) (map[string]interface{}, []request, error) {
 	return config, requests, nil
 }
 
+// readResults reads the result records of a run from its jsonl, csv or parquet file
+func readResults(path string) ([]request, error) {
+	var requests []request
+	err := store.ReadResultFile(path, func(r store.Result) error {
+		requests = append(requests, request{
+			// Log lines were written when the request completed, keep that meaning
+			timestamp:    r.Sent.Add(r.Total).UTC(),
+			eventid:      r.EventID,
+			status:       r.Status,
+			ttfb:         milliseconds(r.TTFB),
+			total:        milliseconds(r.Total),
+			isCold:       r.Cold,
+			dns:          milliseconds(r.DNS),
+			connect:      milliseconds(r.Connect),
+			tls:          milliseconds(r.TLS),
+			errorMessage: r.Error,
+			errorClass:   r.ErrorClass,
+			target:       r.Target,
+			intendedTime: r.Intended.UTC(),
+			sendTime:     r.Sent.UTC(),
+			phase:        r.Phase,
+			protocol:     r.Protocol,
+			grpcStatus:   r.GRPCStatus,
+			outcome:      r.Outcome,
+			errorKind:    r.ErrorKind,
+			probe:        r.Probe,
+		})
+		return nil
+	})
+	return requests, err
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
 func parseConfig(line string) map[string]interface{} {
 	config := make(map[string]interface{})
 	matches := reRequestsPerSecond.FindStringSubmatch(line)
@@ -393,6 +538,10 @@ func parseRequest(line string) (request, error) {
 		req.eventid = s
 	}
 
+	req.intendedTime = parseTime(pairs["intended"])
+	req.sendTime = parseTime(pairs["sent"])
+	req.phase = strings.Trim(pairs["phase"], `"`)
+
 	return req, nil
 }
 
@@ -422,14 +571,39 @@ func parseDuration(s string) float64 {
 	return float64(d.Milliseconds())
 }
 
+// parseTime parses an RFC3339 timestamp, returning the zero time if it is missing or invalid
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t.UTC()
+}
+
+// nullableString stores empty strings as NULL
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullableTime stores zero times as NULL, older logs do not have send times
+func nullableTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
 func insertExperiment(db *sql.DB, exp *experimentInfo, config map[string]interface{}) (int64, error) {
 	stmt := `
         INSERT INTO experiments (
             timestamp, language, scenario, concurrency, rps,
             requests_per_second, duration, max_idle_conns,
             max_idle_conns_per_host, idle_conn_timeout, timeout,
-            triggers, workers
-        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+            triggers, workers, run_id, name, description, tags
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 	args := []interface{}{
 		exp.timestamp.Format(time.RFC3339),
@@ -445,6 +619,10 @@ func insertExperiment(db *sql.DB, exp *experimentInfo, config map[string]interfa
 		config["timeout"],
 		exp.params["triggers"],
 		exp.params["workers"],
+		nullableString(exp.runID),
+		nullableString(exp.name),
+		nullableString(exp.description),
+		nullableString(store.JoinTags(exp.tags)),
 	}
 
 	res, err := db.Exec(stmt, args...)
@@ -452,7 +630,11 @@ func insertExperiment(db *sql.DB, exp *experimentInfo, config map[string]interfa
 		return 0, err
 	}
 
-	return res.LastInsertId()
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return id, store.InsertParams(db, id, exp.extra)
 }
 
 func insertRequests(db *sql.DB, expID int64, requests []request) error {
@@ -465,8 +647,10 @@ func insertRequests(db *sql.DB, expID int64, requests []request) error {
 	stmt, err := tx.Prepare(`
         INSERT INTO requests (
             experiment_id, timestamp, status, ttfb, total_time,
-            is_cold, dns_time, connect_time, tls_time, error_message, event_id, target
-        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            is_cold, dns_time, connect_time, tls_time, error_message, event_id, target,
+            intended_time, send_time, phase, error_class, protocol, grpc_status, outcome, error_kind,
+            probe_outcome, pods_before, pods_after, probe_wait_time
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `)
 	if err != nil {
 		return err
@@ -481,7 +665,7 @@ func insertRequests(db *sql.DB, expID int64, requests []request) error {
 			eventID = req.eventid
 		}
 
-		_, err := stmt.Exec(
+		_, err := stmt.Exec(append([]interface{}{
 			expID,
 			req.timestamp.Format(time.RFC3339Nano),
 			req.status,
@@ -494,7 +678,15 @@ func insertRequests(db *sql.DB, expID int64, requests []request) error {
 			req.errorMessage,
 			eventID,
 			req.target,
-		)
+			nullableTime(req.intendedTime),
+			nullableTime(req.sendTime),
+			req.phase,
+			nullableString(req.errorClass),
+			nullableString(req.protocol),
+			nullableString(req.grpcStatus),
+			nullableString(req.outcome),
+			nullableString(req.errorKind),
+		}, store.ProbeColumns(req.probe)...)...)
 		if err != nil {
 			return err
 		}
@@ -502,3 +694,76 @@ func insertRequests(db *sql.DB, expID int64, requests []request) error {
 
 	return tx.Commit()
 }
+
+// insertPercentiles stores the percentiles of a run's latency histograms, values in milliseconds
+func insertPercentiles(db *sql.DB, expID int64, histogramPath string) error {
+	set, err := latency.ReadFile(histogramPath)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+        INSERT INTO latency_percentiles (
+            experiment_id, target, metric, percentile, value, count
+        ) VALUES (?, ?, ?, ?, ?, ?)
+    `)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range set.Entries() {
+		for _, p := range latency.Percentiles {
+			ms := float64(e.ValueAt(p)) / float64(time.Millisecond)
+			if _, err := stmt.Exec(expID, e.Target, e.Metric, p, ms, e.Histogram.TotalCount()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// mergeHistograms merges the latency histograms of every run in the time window,
+// so percentiles can be computed over repeated runs of the same experiment
+func mergeHistograms(cfg config) error {
+	cutoff := time.Now().Add(-cfg.timeWindow)
+	entries, err := os.ReadDir(cfg.logDir)
+	if err != nil {
+		return fmt.Errorf("reading log directory: %w", err)
+	}
+
+	merged := make(latency.Set)
+	files := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".hlog") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().Before(cutoff) {
+			continue
+		}
+		set, err := latency.ReadFile(filepath.Join(cfg.logDir, entry.Name()))
+		if err != nil {
+			log.Printf("Skipping %q: %v", entry.Name(), err)
+			continue
+		}
+		merged.Merge(set)
+		files++
+	}
+	if files == 0 {
+		return fmt.Errorf("no histogram files found in %s", cfg.logDir)
+	}
+
+	log.Printf("Merged %d histogram files into %s", files, cfg.mergeHdr)
+	if err := merged.WriteTable(os.Stdout); err != nil {
+		return err
+	}
+	return merged.WriteFile(cfg.mergeHdr, cutoff)
+}
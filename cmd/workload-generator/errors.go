@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+)
+
+// errorKey groups the results that were not ok
+type errorKey struct {
+	target, outcome, kind string
+}
+
+// errorTally counts the results written to its sink by target, and those that
+// were not ok by their outcome and error kind, for the table at the end of a run
+type errorTally struct {
+	store.Sink
+	mu      sync.Mutex
+	results map[string]int
+	errors  map[errorKey]int
+}
+
+func newErrorTally(sink store.Sink) *errorTally {
+	return &errorTally{Sink: sink, results: make(map[string]int), errors: make(map[errorKey]int)}
+}
+
+func (t *errorTally) Write(result store.Result) error {
+	t.mu.Lock()
+	t.results[result.Target]++
+	if result.Outcome != store.OutcomeOK {
+		t.errors[errorKey{result.Target, result.Outcome, result.ErrorKind}]++
+	}
+	t.mu.Unlock()
+	return t.Sink.Write(result)
+}
+
+// errorRow is a line of the error table, share is of all results of the target
+type errorRow struct {
+	errorKey
+	count int
+	share float64
+}
+
+// rows returns the errors by target, the most frequent first
+func (t *errorTally) rows() []errorRow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rows := make([]errorRow, 0, len(t.errors))
+	for key, n := range t.errors {
+		rows = append(rows, errorRow{key, n, float64(n) / float64(t.results[key.target])})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].target != rows[j].target {
+			return rows[i].target < rows[j].target
+		}
+		if rows[i].count != rows[j].count {
+			return rows[i].count > rows[j].count
+		}
+		if rows[i].outcome != rows[j].outcome {
+			return rows[i].outcome < rows[j].outcome
+		}
+		return rows[i].kind < rows[j].kind
+	})
+	return rows
+}
+
+// writeErrorTable prints one row per target, outcome and error kind
+func writeErrorTable(w io.Writer, rows []errorRow) error {
+	if len(rows) == 0 {
+		_, err := fmt.Fprintln(w, "no failed requests")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "target\toutcome\tkind\tcount\tshare\t")
+	for _, r := range rows {
+		kind := r.kind
+		if kind == "" {
+			kind = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%.2f%%\t\n", r.target, r.outcome, kind, r.count, 100*r.share)
+	}
+	return tw.Flush()
+}
+
+// reportErrors prints and logs the results that were not ok
+func reportErrors(logger *slog.Logger, tally *errorTally) {
+	rows := tally.rows()
+	if err := writeErrorTable(os.Stdout, rows); err != nil {
+		logger.Error("Failed to print error table", "error", err)
+	}
+	for _, r := range rows {
+		logger.Info("Request errors", "target", r.target, "outcome", r.outcome, "kind", r.kind, "count", r.count, "share", r.share)
+	}
+}
@@ -1,60 +1,175 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/luccadibe/knativeBenchmark/pkg/config"
 	"github.com/luccadibe/knativeBenchmark/pkg/connection"
 	"github.com/luccadibe/knativeBenchmark/pkg/generator"
+	"github.com/luccadibe/knativeBenchmark/pkg/knative"
+	"github.com/luccadibe/knativeBenchmark/pkg/latency"
+	"github.com/luccadibe/knativeBenchmark/pkg/monitor"
 	"github.com/luccadibe/knativeBenchmark/pkg/store"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "matrix":
+			os.Exit(matrixCommand(os.Args[2:]))
+		case "validate":
+			os.Exit(validateCommand(os.Args[2:]))
+		case "config":
+			os.Exit(configCommand(os.Args[2:]))
+		}
+	}
 
-	configPath := flag.String("config", "config.yaml", "path to config file")
-	rps := flag.Float64("rps", 0, "replace config rps with another value")
-	pingEndpoints := flag.Bool("ping", false, "ping endpoints")
-	devMode := flag.Bool("dev", false, "development mode - use localhost:8080")
-	cloudEventMode := flag.Bool("event", false, "cloud event mode - generate cloud events")
-	coldStartMode := flag.Bool("cold-start", false, "cold start mode - send requests to trigger cold start")
-	prefix := flag.String("prefix", "workload-generator", "prefix for log file")
+	opts := newOptions(flag.CommandLine)
 	flag.Parse()
-	logFile := store.GetLogFileWriter(*prefix, "/logs")
-	defer logFile.Close()
 
-	logger := slog.New(slog.NewTextHandler(logFile, nil))
-	logger.Info("Loading configuration", "configPath", *configPath, "devMode", *devMode)
-	cfg, err := config.Load(*configPath, *devMode)
+	cfg, err := config.Load(*opts.configPath, *opts.devMode)
+	if err == nil {
+		err = check(opts, cfg)
+	}
+	if err != nil {
+		printProblems(os.Stderr, *opts.configPath+": ", err)
+		os.Exit(1)
+	}
+	if _, err := runOnce(opts, cfg); err != nil {
+		os.Exit(1)
+	}
+}
+
+// options are the flags of a run
+type options struct {
+	flags          *flag.FlagSet
+	configPath     *string
+	rps            *float64
+	pingEndpoints  *bool
+	devMode        *bool
+	cloudEventMode *bool
+	coldStartMode  *bool
+	traceMode      *bool
+	closedLoopMode *bool
+	searchMode     *bool
+	prefix         *string
+	grace          *time.Duration
+	metricsAddr    *string
+	labels         labels
+}
+
+func newOptions(fs *flag.FlagSet) *options {
+	opts := &options{
+		flags:          fs,
+		configPath:     fs.String("config", "config.yaml", "path to config file"),
+		rps:            fs.Float64("rps", 0, "replace config rps with another value"),
+		pingEndpoints:  fs.Bool("ping", false, "ping endpoints"),
+		devMode:        fs.Bool("dev", false, "development mode - use localhost:8080"),
+		cloudEventMode: fs.Bool("event", false, "cloud event mode - generate cloud events"),
+		coldStartMode:  fs.Bool("cold-start", false, "cold start mode - send requests to trigger cold start"),
+		traceMode:      fs.Bool("trace", false, "trace mode - replay the invocation trace from the config"),
+		closedLoopMode: fs.Bool("closed-loop", false, "closed-loop mode - virtual users wait for each response and think before the next request"),
+		searchMode:     fs.Bool("search", false, "search mode - find the highest rate that meets the SLO in the search section, combine with -event for cloud events"),
+		prefix:         fs.String("prefix", "workload-generator", "prefix for log file, defaults to the experiment name of the config if it has one"),
+		grace:          fs.Duration("grace", 30*time.Second, "on SIGINT or SIGTERM, how long to wait for requests in flight before exiting"),
+		metricsAddr:    fs.String("metrics-addr", "", "serve live Prometheus metrics on /metrics and a JSON summary on /status at this address, e.g. :8080"),
+		labels:         labels{},
+	}
+	fs.Var(opts.labels, "label", "key=value label recorded in the run manifest, can be repeated")
+	return opts
+}
+
+// isSet reports whether the flag name was given on the command line
+func (o *options) isSet(name string) bool {
+	set := false
+	o.flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// runOnce runs a validated cfg with its own log, results and manifest. It
+// returns why the run ended and the error of the generator if it failed, or
+// no reason and an error if the run could not start.
+func runOnce(opts *options, cfg *config.Config) (string, error) {
+	// The config is loaded before the log is opened, the log rotates as it says
+	prefix := *opts.prefix
+	// The experiment names the files unless -prefix is given
+	if p := cfg.Experiment.Prefix(); p != "" && !opts.isSet("prefix") {
+		prefix = p
+	}
+	logFile, err := store.GetLogFileWriter(prefix, "/logs", cfg.Store.Rotation)
 	if err != nil {
-		logger.Error("Failed to load config", "error", err)
+		fmt.Fprintln(os.Stderr, err)
+		return "", err
 	}
+	defer logFile.Close()
+
+	logger := slog.New(slog.NewTextHandler(logFile, nil))
+	logger.Info("Loading configuration", "configPath", *opts.configPath, "devMode", *opts.devMode)
 
-	if *rps > 0 {
-		cfg.Rate.RequestsPerSecond = *rps
-		logger.Info("Overriding RPS", "rps", *rps)
+	if *opts.rps > 0 {
+		cfg.Rate.RequestsPerSecond = *opts.rps
+		logger.Info("Overriding RPS", "rps", *opts.rps)
 	}
 	logger.Info("Loaded configuration", "config", cfg)
 
-	pool := connection.NewPool(cfg.BaseURL, cfg.Rate.MaxIdleConns, cfg.Rate.MaxIdleConnsPerHost, cfg.Rate.IdleConnTimeout, cfg.Rate.Timeout)
+	// The run ID also goes into the SQLite sink, so logparser can tell the run is already stored
+	manifest, err := newManifest(cfg, opts)
+	if err != nil {
+		logger.Error("Failed to create run manifest", "error", err)
+		return "", err
+	}
 
-	if *pingEndpoints {
-		ping(cfg, logger, pool)
+	// Results go next to the log file, the log only has diagnostics
+	results, err := store.NewSink(cfg.Store, strings.TrimSuffix(logFile.Name(), ".log"), manifest)
+	if err != nil {
+		logger.Error("Failed to open result sink", "error", err)
+		return "", err
 	}
+	// The tally counts the failed requests for the error table at the end
+	tally := newErrorTally(results)
 
-	if *cloudEventMode {
-		// get K_SINK from env
-		logger.Info("K_SINK", "K_SINK", os.Getenv("K_SINK"))
+	pool := connection.NewPool(cfg.BaseURL, cfg.Rate.MaxIdleConns, cfg.Rate.MaxIdleConnsPerHost, cfg.Rate.IdleConnTimeout, cfg.Rate.Timeout, cfg.Rate.Protocol)
 
-		kSink := os.Getenv("K_SINK")
-		if kSink == "" {
-			logger.Error("K_SINK is not set")
-			os.Exit(1)
-		}
-		cfg.Targets[0].URL = kSink
+	// The generators stop on ctx, signals cancel it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
 
+	var mon *monitor.Monitor
+	var sink store.Sink = tally
+	if *opts.metricsAddr != "" {
+		mon = monitor.New()
+		pool = mon.WrapPool(pool)
+		sink = mon.WrapSink(tally)
+		// Keeps serving while the requests in flight drain after a signal
+		monCtx, stopMon := context.WithCancel(context.Background())
+		defer stopMon()
+		go mon.Serve(monCtx, *opts.metricsAddr, logger)
+	}
+
+	if *opts.pingEndpoints {
+		ping(cfg, logger, pool)
+	}
+
+	var gen generator.Generator
+	var start func() error
+	if *opts.cloudEventMode {
+		// Event configs send to url: ${K_SINK}, set by Knative on the container source
 		event := cloudevents.NewEvent()
 		event.SetID(cfg.Targets[0].Headers["ce-id"])
 		event.SetSource(cfg.Targets[0].Headers["ce-source"])
@@ -62,37 +177,215 @@ func main() {
 		event.SetDataContentType(cfg.Targets[0].Headers["Content-Type"])
 		event.SetData(cfg.Targets[0].Headers["Content-Type"], cfg.Targets[0].Body)
 		logger.Info("Event", "event", event)
-		gen := generator.NewCloudEventGenerator(cfg, &event, pool, logger)
-
-		logger.Info("Generator initialized")
-		err = gen.Start()
-		if err != nil {
-			logger.Error("Generator failed", "error", err)
+		gen = generator.NewCloudEventGenerator(ctx, cfg, &event, pool, logger, sink)
+		start = gen.Start
+		if *opts.searchMode {
+			start = func() error { return search(cfg, gen) }
 		}
+	} else if *opts.searchMode {
+		gen = generator.New(ctx, cfg, logger, pool, sink)
+		start = func() error { return search(cfg, gen) }
+	} else if *opts.traceMode {
+		gen = generator.NewTraceGenerator(ctx, cfg, logger, pool, sink)
+		start = gen.Start
+	} else if *opts.closedLoopMode {
+		gen = generator.NewClosedLoopGenerator(ctx, cfg, logger, pool, sink)
+		start = gen.Start
+	} else if *opts.coldStartMode {
+		gen = generator.NewColdStartGenerator(ctx, cfg, logger, pool, sink, replicas(cfg, logger))
+		start = gen.StartColdStart
+	} else {
+		gen = generator.New(ctx, cfg, logger, pool, sink)
+		start = gen.Start
+	}
+	watch(mon, gen)
+	logger.Info("Generator initialized")
+
+	manifestPath := store.ManifestPath(logFile.Name())
+	manifest.Start = time.Now().UTC()
+	if err := store.WriteManifest(manifestPath, manifest); err != nil {
+		logger.Error("Failed to write run manifest", "error", err)
+		results.Close()
+		return "", err
+	}
+	logger.Info("Run manifest written", "path", manifestPath, "runId", manifest.RunID)
+
+	reason, runErr := run(logger, gen, start, cancel, signals, *opts.grace)
+	end := time.Now().UTC()
+	manifest.End = &end
+	if err := store.WriteManifest(manifestPath, manifest); err != nil {
+		logger.Error("Failed to write run manifest", "error", err)
+	}
+	if err := results.Close(); err != nil {
+		logger.Error("Failed to close result sink", "error", err)
+	}
+	if dropped := results.Dropped(); dropped > 0 {
+		logger.Warn("Results dropped because the sink fell behind", "dropped", dropped, "buffer", cfg.Store.Buffer)
+		fmt.Printf("%d results dropped, raise store.buffer\n", dropped)
+	}
+	reportTargetMix(cfg, logger, pool)
+	reportErrors(logger, tally)
+	reportLatency(logger, gen.GetRecorder(), strings.TrimSuffix(logFile.Name(), ".log")+".hlog")
+	logFile.Sync()
+	return reason, runErr
+}
+
+// Reasons a run ended, logged in the run summary
+const (
+	endCompleted     = "completed"
+	endFailed        = "failed"
+	endSignal        = "signal"
+	endGraceExceeded = "grace period exceeded"
+	endForced        = "forced"
+)
+
+// run starts the generator and waits for it. On the first signal the generator
+// stops sending and gets up to grace to drain the requests in flight, a second
+// signal stops waiting right away. It logs the run summary either way and returns the end
+// reason with the error of the generator.
+func run(logger *slog.Logger, gen generator.Generator, start func() error, cancel context.CancelFunc, signals <-chan os.Signal, grace time.Duration) (string, error) {
+	began := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		err := start()
 		gen.Stop()
-	} else if *coldStartMode {
-		gen := generator.New(cfg, logger, pool)
-		logger.Info("Generator initialized")
-		err = gen.StartColdStart()
-		if err != nil {
-			logger.Error("Cold start failed", "error", err)
+		done <- err
+	}()
+
+	reason := endCompleted
+	var err error
+	var sig os.Signal
+	select {
+	case err = <-done:
+	case sig = <-signals:
+		logger.Info("Received signal, draining requests in flight", "signal", sig, "grace", grace)
+		cancel()
+		reason = endSignal
+		select {
+		case err = <-done:
+		case <-time.After(grace):
+			reason = endGraceExceeded
+		case <-signals:
+			reason = endForced
 		}
-		gen.Stop()
-	} else {
-		gen := generator.New(cfg, logger, pool)
-		logger.Info("Generator initialized")
+	}
+	if err != nil {
+		logger.Error("Generator failed", "error", err)
+		if reason == endCompleted {
+			reason = endFailed
+		}
+	}
 
-		err = gen.Start()
-		if err != nil {
-			logger.Error("Generator failed", "error", err)
+	summary := gen.Summary()
+	attrs := []any{
+		"endReason", reason,
+		"planned", summary.Planned,
+		"sent", summary.Sent,
+		"completed", summary.Completed,
+		"notSent", summary.Planned - summary.Sent,
+		"abandoned", summary.Sent - summary.Completed,
+		"duration", time.Since(began),
+	}
+	if sig != nil {
+		attrs = append(attrs, "signal", sig.String())
+	}
+	logger.Info("Run summary", attrs...)
+	fmt.Printf("run %s: planned %d, sent %d, completed %d\n", reason, summary.Planned, summary.Sent, summary.Completed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generator failed: %v\n", err)
+	}
+	return reason, err
+}
+
+// replicas connects to the Kubernetes API when the cold start mode confirms scale to zero,
+// so probes can also record the pods before and after
+func replicas(cfg *config.Config, logger *slog.Logger) knative.Replicas {
+	if cfg.ColdStart.Confirm == "" || cfg.ColdStart.Confirm == config.ConfirmNone {
+		return nil
+	}
+	r, err := knative.NewClusterReplicas()
+	if err != nil {
+		logger.Warn("Cannot watch replicas, pod counts are not recorded", "error", err)
+		return nil
+	}
+	return r
+}
+
+// search runs the throughput search and prints the stages and the result
+func search(cfg *config.Config, gen generator.Generator) error {
+	result, err := gen.StartSearch()
+	if err != nil {
+		return fmt.Errorf("search failed: %w", err)
+	}
+	return result.WriteTable(os.Stdout, cfg.Search.SLO)
+}
+
+// reportLatency prints the latency percentiles per target and stores the histograms next to the log file
+func reportLatency(logger *slog.Logger, recorder *latency.Recorder, histogramPath string) {
+	set := recorder.Snapshot()
+	if err := set.WriteTable(os.Stdout); err != nil {
+		logger.Error("Failed to print latency table", "error", err)
+	}
+	for _, e := range set.Entries() {
+		attrs := []any{"target", e.Target, "metric", e.Metric, "count", e.Histogram.TotalCount()}
+		for _, p := range latency.Percentiles {
+			attrs = append(attrs, fmt.Sprintf("p%v", p), e.ValueAt(p))
 		}
-		gen.Stop()
+		logger.Info("Latency percentiles", attrs...)
+	}
+
+	if err := recorder.WriteFile(histogramPath); err != nil {
+		logger.Error("Failed to write latency histograms", "error", err)
+		return
+	}
+	logger.Info("Latency histograms written", "path", histogramPath)
+}
+
+// watch points the live status of the monitor, if there is one, at gen
+func watch(mon *monitor.Monitor, gen generator.Generator) {
+	if mon == nil {
+		return
+	}
+	mon.SetSource(func() (string, float64) {
+		status := gen.Status()
+		return status.Phase, status.TargetRate
+	})
+}
+
+// reportTargetMix logs the share of requests each target actually received, next to
+// the share its weight asked for if the target selection goes by weight
+func reportTargetMix(cfg *config.Config, logger *slog.Logger, pool connection.Pool) {
+	counts := pool.Targets()
+	sent, weights := 0, 0
+	for _, target := range cfg.Targets {
+		sent += counts[target]
+		weights += target.Weight
+	}
+	if sent == 0 {
+		return
+	}
+	// With every target on every arrival the weights play no part
+	weighted := weights > 0 && (cfg.Rate.TargetSelection == config.SelectWeighted || cfg.Rate.TargetSelection == config.SelectSmooth)
+	for _, target := range cfg.Targets {
+		attrs := []any{
+			"target", target.URL,
+			"requests", counts[target],
+			"share", float64(counts[target]) / float64(sent),
+		}
+		if weighted {
+			attrs = append(attrs, "weightShare", float64(target.Weight)/float64(weights))
+		}
+		logger.Info("Target mix", attrs...)
 	}
 }
 
 func ping(cfg *config.Config, logger *slog.Logger, pool connection.Pool) {
 	for _, target := range cfg.Targets {
-		resp, err := pool.Get(target)
+		call := pool.Send
+		if target.Type == config.TargetGRPC {
+			call = pool.Invoke
+		}
+		resp, err := call(target)
 		if err != nil {
 			logger.Error("Failed to ping endpoint", "target", target.URL, "error", err)
 			panic(err)
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/luccadibe/knativeBenchmark/pkg/connection"
+	"github.com/luccadibe/knativeBenchmark/pkg/generator"
+)
+
+func TestRunReturnsGeneratorError(t *testing.T) {
+	failure := errors.New("ramp-up failed")
+	tests := []struct {
+		name       string
+		err        error
+		wantReason string
+	}{
+		{name: "completed", wantReason: endCompleted},
+		{name: "failed", err: failure, wantReason: endFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Targets: []*config.Target{{URL: "http://hello.functions.example.com", Weight: 1}}}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			gen := generator.New(ctx, cfg, logger, connection.NewPoolMock(cfg), newErrorTally(nil))
+
+			reason, err := run(logger, gen, func() error { return tt.err }, cancel, make(chan os.Signal), time.Second)
+			if reason != tt.wantReason || !errors.Is(err, tt.err) {
+				t.Errorf("got %q and %v, expected %q and %v", reason, err, tt.wantReason, tt.err)
+			}
+		})
+	}
+}
+
+func TestReportTargetMix(t *testing.T) {
+	for _, selection := range []string{config.SelectAll, config.SelectWeighted, config.SelectSmooth} {
+		t.Run(selection, func(t *testing.T) {
+			cfg := &config.Config{Targets: []*config.Target{
+				{URL: "http://a.functions.example.com", Weight: 3},
+				{URL: "http://b.functions.example.com", Weight: 1},
+			}}
+			cfg.Rate.TargetSelection = selection
+			pool := connection.NewPoolMock(cfg)
+			for _, target := range cfg.Targets {
+				pool.Send(target)
+			}
+			var log bytes.Buffer
+
+			reportTargetMix(cfg, slog.New(slog.NewTextHandler(&log, nil)), pool)
+
+			lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("logged %q", log.String())
+			}
+			for _, line := range lines {
+				if !strings.Contains(line, "share=0.5") {
+					t.Errorf("line %q lacks the share of requests", line)
+				}
+				if got, want := strings.Contains(line, "weightShare="), selection != config.SelectAll; got != want {
+					t.Errorf("line %q has a weight share: %v, expected %v", line, got, want)
+				}
+			}
+		})
+	}
+}
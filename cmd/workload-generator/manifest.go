@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+)
+
+// Set at build time with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// labels collects repeated -label key=value flags
+type labels map[string]string
+
+func (l labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + l[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l labels) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("label %q is not key=value", value)
+	}
+	l[k] = v
+	return nil
+}
+
+// newManifest describes the run that is about to start with cfg
+func newManifest(cfg *config.Config, opts *options) (*store.Manifest, error) {
+	resolved, err := cfg.Map()
+	if err != nil {
+		return nil, err
+	}
+	flags := make(map[string]string)
+	opts.flags.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	hostname, _ := os.Hostname()
+	return &store.Manifest{
+		RunID:      uuid.NewString(),
+		Experiment: cfg.Experiment,
+		Config:     resolved,
+		Flags:      flags,
+		Version:    version,
+		Commit:     buildCommit(),
+		Start:      time.Now().UTC(),
+		Hostname:   hostname,
+		KSink:      os.Getenv("K_SINK"),
+		Labels:     opts.labels,
+	}, nil
+}
+
+// buildCommit is the commit set at build time, or the one the Go toolchain stamped into the binary
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+	return ""
+}
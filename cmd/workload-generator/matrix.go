@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+const matrixUsage = "usage: workload-generator matrix list|validate|run -config file [flags]"
+
+// matrixCommand lists, validates or runs the expansion of a config with a matrix block.
+// It returns the exit code.
+func matrixCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, matrixUsage)
+		return 2
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("matrix "+action, flag.ExitOnError)
+	opts := newOptions(fs)
+	cooldown := fs.Duration("cooldown", 0, "pause between two runs, replaces matrix.cooldown")
+	fs.Parse(args[1:])
+
+	m, runs, err := config.Expand(*opts.configPath, *opts.devMode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if action != "list" && !checkRuns(opts, m, runs) {
+		return 1
+	}
+	switch action {
+	case "list":
+		listRuns(os.Stdout, m, runs)
+		return 0
+	case "validate":
+		fmt.Printf("%s is valid, it expands into %d runs\n", *opts.configPath, len(runs))
+		return 0
+	case "run":
+		pause := m.Cooldown.Duration
+		if opts.isSet("cooldown") {
+			pause = *cooldown
+		}
+		return runMatrix(opts, m, runs, pause)
+	default:
+		fmt.Fprintln(os.Stderr, matrixUsage)
+		return 2
+	}
+}
+
+// listRuns prints one line per run with its params and what it will do
+func listRuns(w io.Writer, m *config.Matrix, runs []config.Run) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tparams\texperiment\ttargets\trps\tduration")
+	for _, r := range runs {
+		cfg := r.Config
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%v\t%s\n", r.Index, r.Name(m), cfg.Experiment.Prefix(), len(cfg.Targets), cfg.Rate.RequestsPerSecond, cfg.Rate.Duration.Duration)
+	}
+	tw.Flush()
+}
+
+// runMatrix runs every expansion in order with pause in between. A signal
+// drains the current run as usual and skips the rest, a run whose generator
+// failed does not stop the others but fails the matrix.
+func runMatrix(opts *options, m *config.Matrix, runs []config.Run, pause time.Duration) int {
+	var failed []string
+	for i, r := range runs {
+		if i > 0 && pause > 0 {
+			fmt.Printf("cooling down for %s\n", pause)
+			if !wait(pause) {
+				fmt.Printf("matrix interrupted, %d of %d runs done\n", i, len(runs))
+				return 1
+			}
+		}
+		fmt.Printf("run %d/%d: %s\n", i+1, len(runs), r.Name(m))
+		reason, err := runOnce(opts, r.Config)
+		if reason == "" {
+			fmt.Printf("run %d/%d failed to start: %v\n", i+1, len(runs), err)
+			return 1
+		}
+		if err != nil {
+			failed = append(failed, strconv.Itoa(i+1))
+		}
+		if reason != endCompleted && reason != endFailed {
+			fmt.Printf("matrix interrupted, %d of %d runs done\n", i+1, len(runs))
+			return 1
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Printf("runs %s of %d failed\n", strings.Join(failed, ", "), len(runs))
+		return 1
+	}
+	return 0
+}
+
+// wait sleeps for d and reports false if SIGINT or SIGTERM cut it short
+func wait(d time.Duration) bool {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	select {
+	case <-signals:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+const configUsage = "usage: workload-generator config render -config file"
+
+// configCommand prints the effective config of a file that extends or includes
+// others, and checks that it loads. It returns the exit code.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "render" {
+		fmt.Fprintln(os.Stderr, configUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("config render", flag.ExitOnError)
+	path := fs.String("config", "config.yaml", "path to config file")
+	fs.Parse(args[1:])
+
+	data, err := config.Render(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *path, err)
+		return 1
+	}
+	os.Stdout.Write(data)
+
+	isMatrix, err := config.IsMatrix(*path)
+	if err == nil {
+		if isMatrix {
+			_, _, err = config.Expand(*path, false)
+		} else {
+			_, err = config.Load(*path, false)
+		}
+	}
+	if err != nil {
+		printProblems(os.Stderr, *path+": ", err)
+		return 1
+	}
+	return 0
+}
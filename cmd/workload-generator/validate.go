@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+// modes maps the mode flags to the modes config.Validate checks for
+func (o *options) modes() []string {
+	var modes []string
+	if *o.cloudEventMode {
+		modes = append(modes, config.ModeEvent)
+	}
+	switch {
+	case *o.searchMode:
+		modes = append(modes, config.ModeSearch)
+	case *o.cloudEventMode:
+	case *o.traceMode:
+		modes = append(modes, config.ModeTrace)
+	case *o.closedLoopMode:
+		modes = append(modes, config.ModeClosedLoop)
+	case *o.coldStartMode:
+		modes = append(modes, config.ModeColdStart)
+	default:
+		modes = append(modes, config.ModeRate)
+	}
+	return modes
+}
+
+// check applies the -rps override and validates cfg for the modes of opts
+func check(opts *options, cfg *config.Config) error {
+	if *opts.rps > 0 {
+		cfg.Rate.RequestsPerSecond = *opts.rps
+	}
+	return cfg.Validate(opts.modes()...)
+}
+
+// validateCommand checks a config, or every run of a matrix, for the modes
+// given as flags and prints each problem with its YAML path. It returns the exit code.
+func validateCommand(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	opts := newOptions(fs)
+	fs.Parse(args)
+	path := *opts.configPath
+
+	isMatrix, err := config.IsMatrix(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+	if !isMatrix {
+		cfg, err := config.Load(path, *opts.devMode)
+		if err == nil {
+			err = check(opts, cfg)
+		}
+		if err != nil {
+			printProblems(os.Stderr, path+": ", err)
+			return 1
+		}
+		fmt.Printf("%s is valid\n", path)
+		return 0
+	}
+
+	m, runs, err := config.Expand(path, *opts.devMode)
+	if err != nil {
+		printProblems(os.Stderr, path+": ", err)
+		return 1
+	}
+	if !checkRuns(opts, m, runs) {
+		return 1
+	}
+	fmt.Printf("%s is valid, it expands into %d runs\n", path, len(runs))
+	return 0
+}
+
+// checkRuns validates every run of a matrix and prints the problems, it reports whether all runs are valid
+func checkRuns(opts *options, m *config.Matrix, runs []config.Run) bool {
+	valid := true
+	for _, r := range runs {
+		if err := check(opts, r.Config); err != nil {
+			printProblems(os.Stderr, fmt.Sprintf("run %d (%s): ", r.Index, r.Name(m)), err)
+			valid = false
+		}
+	}
+	return valid
+}
+
+// printProblems writes one line per problem of a *config.ValidationError, or err itself
+func printProblems(w io.Writer, prefix string, err error) {
+	var invalid *config.ValidationError
+	if !errors.As(err, &invalid) {
+		fmt.Fprintf(w, "%s%v\n", prefix, err)
+		return
+	}
+	for _, p := range invalid.Problems {
+		fmt.Fprintf(w, "%s%s\n", prefix, p)
+	}
+}
@@ -1,7 +1,8 @@
 package config
 
 import (
-	"os"
+	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/luccadibe/knativeBenchmark/pkg/store"
@@ -10,18 +11,74 @@ import (
 )
 
 type Config struct {
-	Targets []*Target   `yaml:"targets"`
-	Rate    Rate        `yaml:"rate"`
-	BaseURL string      `yaml:"baseUrl"`
-	Store   store.Store `yaml:"store"`
+	// Experiment names the run and its parameters for the manifest and the results
+	Experiment store.Experiment `yaml:"experiment"`
+	Targets    []*Target        `yaml:"targets"`
+	Rate       Rate             `yaml:"rate"`
+	Phases     []Phase          `yaml:"phases"`
+	Trace      *Trace           `yaml:"trace,omitempty"`
+	// ClosedLoop configures the virtual users of the closed-loop mode
+	ClosedLoop ClosedLoop `yaml:"closedLoop"`
+	// Search configures the maximum sustainable throughput search mode
+	Search Search `yaml:"search"`
+	// ColdStart configures how the cold start mode makes sure targets scaled to zero
+	ColdStart ColdStart   `yaml:"coldStart"`
+	BaseURL   string      `yaml:"baseUrl"`
+	Store     store.Store `yaml:"store"`
+	// Matrix expands the file into several runs, it is nil in each of them
+	Matrix *Matrix `yaml:"matrix,omitempty"`
 }
 
 type Target struct {
-	URL        string            `yaml:"url"`
-	Headers    map[string]string `yaml:"headers,omitempty"`
-	Weight     int               `yaml:"weight"`
-	HostHeader string            `yaml:"-"`
-	Body       string            `yaml:"body"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Weight is the share of arrivals the target gets with weighted or smooth
+	// selection, 1 if it is not set. 0 excludes the target.
+	Weight     int    `yaml:"weight"`
+	HostHeader string `yaml:"-"`
+	Body       string `yaml:"body"`
+	// Method is the HTTP method, GET by default or POST for targets with a body
+	Method string `yaml:"method,omitempty"`
+	// BodyFile and BodySize replace Body with the contents of a file or with
+	// BodySize random bytes, read or generated once when the config is loaded
+	BodyFile string `yaml:"bodyFile,omitempty"`
+	BodySize int    `yaml:"bodySize,omitempty"`
+	// ContentType of the body, by default application/json for Body and
+	// application/octet-stream for BodyFile and BodySize
+	ContentType string `yaml:"contentType,omitempty"`
+	// Expect are the rules a response must meet to count as ok
+	Expect *Expect `yaml:"expect,omitempty"`
+	// TraceFunction is the function ID from the trace that is replayed against this target
+	TraceFunction string `yaml:"traceFunction,omitempty"`
+	// Service and Namespace name the Knative Service behind the target,
+	// by default they are the first two labels of the host (name.namespace.svc.cluster.local)
+	Service   string `yaml:"service,omitempty"`
+	Namespace string `yaml:"namespace,omitempty"`
+	// Protocol replaces Rate.Protocol for this target
+	Protocol string `yaml:"protocol,omitempty"`
+	// Type is http (default) or grpc
+	Type string `yaml:"type,omitempty"`
+	// GRPC names the method a grpc target calls, the body is its request as JSON
+	GRPC *GRPC `yaml:"grpc,omitempty"`
+
+	templates *targetTemplates
+	payload   []byte
+}
+
+// Target types
+const (
+	TargetHTTP = "http"
+	// TargetGRPC makes unary calls over h2c for http URLs and over TLS for https URLs
+	TargetGRPC = "grpc"
+)
+
+// GRPC describes the unary method a grpc target calls
+type GRPC struct {
+	// Method is the full method name, package.Service/Method
+	Method string `yaml:"method"`
+	// DescriptorSet is a file written by protoc --include_imports --descriptor_set_out.
+	// Without it the method is looked up with server reflection.
+	DescriptorSet string `yaml:"descriptorSet,omitempty"`
 }
 
 // Custom duration type for YAML parsing
@@ -44,6 +101,10 @@ func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
 type Rate struct {
 	RequestsPerSecond   float64       `yaml:"requestsPerSecond"`
 	Duration            Duration      `yaml:"duration"`
@@ -51,18 +112,276 @@ type Rate struct {
 	MaxIdleConnsPerHost int           `yaml:"maxIdleConnsPerHost"`
 	IdleConnTimeout     time.Duration `yaml:"idleConnTimeout"`
 	Timeout             time.Duration `yaml:"timeout"`
+	Arrival             Arrival       `yaml:"arrival"`
+	// TargetSelection decides which targets get a request on each arrival
+	TargetSelection string `yaml:"targetSelection"`
+	// Protocol is the HTTP version requests are sent with, http1 by default
+	Protocol string `yaml:"protocol"`
+}
+
+// ProtocolOf returns the protocol requests to t are sent with
+func (c *Config) ProtocolOf(t *Target) string {
+	if t.Protocol != "" {
+		return t.Protocol
+	}
+	if c.Rate.Protocol != "" {
+		return c.Rate.Protocol
+	}
+	return ProtocolHTTP1
+}
+
+// Protocols of Rate.Protocol and Target.Protocol
+const (
+	ProtocolHTTP1 = "http1"
+	// ProtocolH2 offers HTTP/2 over TLS, servers without it get HTTP/1.1
+	ProtocolH2 = "h2"
+	// ProtocolH2C speaks HTTP/2 over plain TCP without upgrade
+	ProtocolH2C = "h2c"
+	// ProtocolH3 is HTTP/3 over QUIC
+	ProtocolH3 = "h3"
+)
+
+// Target selection modes
+const (
+	// SelectAll sends one request to every target per arrival
+	SelectAll = "all"
+	// SelectWeighted picks one target per arrival at random, proportional to its weight
+	SelectWeighted = "weighted"
+	// SelectSmooth picks one target per arrival with smooth weighted round-robin
+	SelectSmooth = "smooth"
+)
+
+// Arrival process used to space requests at the configured rate
+const (
+	ArrivalConstant = "constant"
+	ArrivalPoisson  = "poisson"
+	ArrivalUniform  = "uniform"
+	ArrivalGamma    = "gamma"
+)
+
+// Arrival describes how inter-arrival times are drawn around the mean
+// interval 1/RequestsPerSecond. An empty process means constant.
+type Arrival struct {
+	Process string `yaml:"process"`
+	// Jitter is the maximum relative deviation for the uniform process, e.g. 0.5 = +-50%
+	Jitter float64 `yaml:"jitter"`
+	// CV is the coefficient of variation for the gamma process. 1 behaves like poisson.
+	CV float64 `yaml:"cv"`
+	// Seed makes the sequence reproducible. 0 picks a random seed.
+	Seed int64 `yaml:"seed"`
+}
+
+// Trace file formats
+const (
+	TraceAzure = "azure"
+	TraceJSONL = "jsonl"
+)
+
+// Trace spreads, where the counts of the azure format are placed inside their minute
+const (
+	// SpreadUniform places every invocation at a random point of its minute, the default
+	SpreadUniform = "uniform"
+	// SpreadEven places the invocations of a minute at equal gaps from its start
+	SpreadEven = "even"
+)
+
+// Trace replays recorded invocations instead of a synthetic rate.
+// The azure format is the per-minute invocation count CSV of the Azure Functions
+// traces (HashFunction column plus one column per minute). The jsonl format has one
+// {"function": "...", "timestamp": seconds} object per line.
+// If no target sets traceFunction, the busiest functions are mapped onto the targets in order.
+type Trace struct {
+	Path   string `yaml:"path"`
+	Format string `yaml:"format"`
+	// Speedup compresses time, 6 replays an hour of trace in ten minutes
+	Speedup     float64 `yaml:"speedup"`
+	StartMinute int     `yaml:"startMinute"`
+	// Minutes limits the replayed window, 0 replays until the end of the trace
+	Minutes int `yaml:"minutes"`
+	// Spread places per-minute counts inside the minute, see the Spread constants
+	Spread string `yaml:"spread"`
+	Seed   int64  `yaml:"seed"`
+}
+
+// Think time distributions for closed-loop users
+const (
+	ThinkConstant    = "constant"
+	ThinkExponential = "exponential"
+)
+
+// ClosedLoop runs a fixed number of virtual users that each send a request,
+// wait for the response, think and repeat.
+// Without stages, Users run for rate.duration.
+type ClosedLoop struct {
+	Users     int      `yaml:"users"`
+	ThinkTime Duration `yaml:"thinkTime"`
+	// ThinkTimeDistribution is constant or exponential (with thinkTime as the mean)
+	ThinkTimeDistribution string `yaml:"thinkTimeDistribution"`
+	// Stages change the number of users over time, they run in order
+	Stages []UserStage `yaml:"stages"`
+}
+
+// UserStage holds Users virtual users for Duration
+type UserStage struct {
+	Name     string   `yaml:"name"`
+	Users    int      `yaml:"users"`
+	Duration Duration `yaml:"duration"`
+}
+
+// Ways the cold start mode confirms a target scaled to zero before probing it
+const (
+	ConfirmNone     = "none"
+	ConfirmReplicas = "replicas"
+	ConfirmIdle     = "idle"
+)
+
+// ColdStart configures the cold start mode. Every target is probed in turn,
+// after confirming it has no pods left.
+type ColdStart struct {
+	// Gap is the pause after each probe, defaults to 7s
+	Gap Duration `yaml:"gap"`
+	// Confirm is none (default), replicas to watch the ready pods of the Knative Revision,
+	// or idle to wait IdlePeriod since the target's last probe
+	Confirm    string   `yaml:"confirm"`
+	IdlePeriod Duration `yaml:"idlePeriod"`
+	// PollInterval between replica checks, defaults to 2s
+	PollInterval Duration `yaml:"pollInterval"`
+	// Timeout for the scale to zero in replicas mode, defaults to 5m
+	Timeout Duration `yaml:"timeout"`
+}
+
+// Search looks for the highest rate that still meets the SLO. It runs short
+// stages, multiplying the rate by StepFactor while the SLO holds and bisecting
+// between the best passing and the lowest failing rate after the first failure.
+type Search struct {
+	StartRate float64 `yaml:"startRate"`
+	MaxRate   float64 `yaml:"maxRate"`
+	// StepFactor multiplies the rate after a passing stage until the first failure, defaults to 2
+	StepFactor float64 `yaml:"stepFactor"`
+	// Precision stops the bisection once the gap is below this fraction of the failing rate, defaults to 0.05
+	Precision     float64  `yaml:"precision"`
+	StageDuration Duration `yaml:"stageDuration"`
+	// Warmup runs at the stage rate before measuring, so scale-up is not judged
+	Warmup   Duration `yaml:"warmup"`
+	Cooldown Duration `yaml:"cooldown"`
+	// MaxStages bounds the number of stages, defaults to 20
+	MaxStages int `yaml:"maxStages"`
+	SLO       SLO `yaml:"slo"`
+}
+
+// SLO a search stage has to meet
+type SLO struct {
+	// Percentile of TTFB that is checked, defaults to 99
+	Percentile float64  `yaml:"percentile"`
+	MaxTTFB    Duration `yaml:"maxTtfb"`
+	// MaxErrorRate is the allowed fraction of requests whose outcome is not ok, e.g. 0.01
+	MaxErrorRate float64 `yaml:"maxErrorRate"`
+}
+
+// Load profile shapes for a phase
+const (
+	ShapeConstant = "constant"
+	ShapeRamp     = "ramp"
+	ShapeStep     = "step"
+	ShapeSpike    = "spike"
+	ShapeSine     = "sine"
+)
+
+// Phase is one stage of a load profile. Phases run in order and replace the
+// default ramp-up followed by a flat rate. Which fields are used depends on the shape:
+//   - constant: rate
+//   - ramp: from, to (linear over the whole phase)
+//   - step: from, to, steps (equal length steps, both ends included)
+//   - spike: rate, peak, spikeAt, spikeDuration
+//   - sine: rate, amplitude, period
+type Phase struct {
+	Name          string   `yaml:"name"`
+	Duration      Duration `yaml:"duration"`
+	Shape         string   `yaml:"shape"`
+	Rate          float64  `yaml:"rate"`
+	From          float64  `yaml:"from"`
+	To            float64  `yaml:"to"`
+	Steps         int      `yaml:"steps"`
+	Peak          float64  `yaml:"peak"`
+	SpikeAt       Duration `yaml:"spikeAt"`
+	SpikeDuration Duration `yaml:"spikeDuration"`
+	Amplitude     float64  `yaml:"amplitude"`
+	Period        Duration `yaml:"period"`
+}
+
+// Map returns the config as the generic map it would be read from, with the keys of the YAML file
+func (c *Config) Map() (map[string]interface{}, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	m, _ := stringKeys(raw).(map[string]interface{})
+	return m, nil
+}
+
+// stringKeys converts the maps yaml.v2 decodes into maps with string keys, as JSON needs them
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			m[fmt.Sprint(k)] = stringKeys(value)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = stringKeys(v[i])
+		}
+		return v
+	default:
+		return v
+	}
 }
 
 func Load(path string, devMode bool) (*Config, error) {
-	data, err := os.ReadFile(path)
+	data, err := read(path)
 	if err != nil {
 		return nil, err
 	}
+	m, err := readMatrix(data)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		return nil, fmt.Errorf("%s has a matrix block, run it with the matrix command", path)
+	}
+	return parse(data, devMode)
+}
+
+// parse reads a config without a matrix, or a run of a matrix after its params
+// were substituted. Unknown fields are a *ValidationError.
+func parse(data []byte, devMode bool) (*Config, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if problems := unknownFields("", doc, reflect.TypeOf(Config{})); len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
 
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
 		return nil, err
 	}
+	defaultWeights(doc, cfg.Targets)
+	if problems := compileTemplates(cfg.Targets); len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	if problems := compileExpectations(cfg.Targets); len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	if problems := loadPayloads(cfg.Targets); len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
 
 	if devMode {
 		cfg.BaseURL = "http://localhost:8080"
@@ -74,3 +393,28 @@ func Load(path string, devMode bool) (*Config, error) {
 	}
 	return &cfg, nil
 }
+
+// defaultWeights sets the weight of the targets that do not have one in doc
+// to 1, so weights only need to be set where they differ and weight: 0 can
+// exclude a target
+func defaultWeights(doc yaml.MapSlice, targets []*Target) {
+	for _, item := range doc {
+		list, ok := item.Value.([]interface{})
+		if item.Key != "targets" || !ok {
+			continue
+		}
+		for i, raw := range list {
+			if i >= len(targets) || targets[i] == nil {
+				continue
+			}
+			fields, _ := raw.(yaml.MapSlice)
+			set := false
+			for _, field := range fields {
+				set = set || field.Key == "weight"
+			}
+			if !set {
+				targets[i].Weight = 1
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPlaceholder matches ${VAR} and ${VAR:-default}, with $$ escaping the
+// dollar. ${matrix.param} is left to the matrix.
+var envPlaceholder = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// interpolate replaces environment variables in the string values of a parsed
+// config file, so comments and keys are left alone and a variable cannot add
+// YAML structure. A value that becomes a number or a boolean is read as one.
+// ${VAR:-default} falls back to default when VAR is unset or empty, ${VAR}
+// fails the load when VAR is unset, so e.g. K_SINK is checked before a run starts.
+// It reports whether any value changed.
+func interpolate(doc yaml.MapSlice) (bool, error) {
+	var missing []string
+	changed := false
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case yaml.MapSlice:
+			for i := range v {
+				v[i].Value = walk(v[i].Value)
+			}
+		case []interface{}:
+			for i := range v {
+				v[i] = walk(v[i])
+			}
+		case string:
+			out := expand(v, &missing)
+			if out == v {
+				return v
+			}
+			changed = true
+			return scalar(out)
+		}
+		return v
+	}
+	walk(doc)
+	if len(missing) > 0 {
+		return false, fmt.Errorf("environment variables without a default are not set: %s", strings.Join(missing, ", "))
+	}
+	return changed, nil
+}
+
+// expand replaces the placeholders in s, adding the unset variables without a default to missing
+func expand(s string, missing *[]string) string {
+	return envPlaceholder.ReplaceAllStringFunc(s, func(placeholder string) string {
+		if strings.HasPrefix(placeholder, "$$") {
+			return placeholder[1:]
+		}
+		m := envPlaceholder.FindStringSubmatch(placeholder)
+		value, set := os.LookupEnv(m[1])
+		if m[2] != "" {
+			if value == "" {
+				return strings.TrimPrefix(m[2], ":-")
+			}
+			return value
+		}
+		if !set {
+			*missing = append(*missing, m[1])
+		}
+		return value
+	})
+}
+
+// scalar reads an interpolated value as YAML would have, if it is a number or
+// a boolean. Anything else, including what would parse as a list or a map, stays a string.
+func scalar(s string) interface{} {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	switch v.(type) {
+	case int, int64, uint64, float64, bool:
+		return v
+	}
+	return s
+}
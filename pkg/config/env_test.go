@@ -0,0 +1,119 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(text), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("BENCH_HOST", "hello.functions.example.com")
+	t.Setenv("BENCH_RPS", "25")
+	t.Setenv("BENCH_FLAG", "true")
+	t.Setenv("BENCH_INJECT", "x\nrate:\n  requestsPerSecond: 1000")
+	t.Setenv("BENCH_LIST", "[a, b]")
+	t.Setenv("BENCH_EMPTY", "")
+
+	cfg, err := Load(writeConfig(t, `
+# ${BENCH_UNSET} in a comment is left alone
+targets:
+  - url: "http://${BENCH_HOST}/"
+    body: ${BENCH_RPS}
+    headers:
+      X-Inject: ${BENCH_INJECT}
+      X-List: ${BENCH_LIST}
+      X-Literal: $${BENCH_HOST}
+      X-Default: ${BENCH_EMPTY:-fallback}
+rate:
+  requestsPerSecond: ${BENCH_RPS}
+  duration: ${BENCH_UNSET_DURATION:-90s}
+experiment:
+  tags: ["${BENCH_FLAG}"]
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := cfg.Targets[0]
+	if target.URL != "http://hello.functions.example.com/" {
+		t.Errorf("url is %q", target.URL)
+	}
+	// A number goes into a string field as written
+	if target.Body != "25" {
+		t.Errorf("body is %q", target.Body)
+	}
+	if cfg.Rate.RequestsPerSecond != 25 {
+		t.Errorf("requestsPerSecond is %v, the injected value must not apply", cfg.Rate.RequestsPerSecond)
+	}
+	if cfg.Rate.Duration.Duration != 90*time.Second {
+		t.Errorf("duration is %s", cfg.Rate.Duration.Duration)
+	}
+	for name, want := range map[string]string{
+		"X-Inject":  "x\nrate:\n  requestsPerSecond: 1000",
+		"X-List":    "[a, b]",
+		"X-Literal": "${BENCH_HOST}",
+		"X-Default": "fallback",
+	} {
+		if got := target.Headers[name]; got != want {
+			t.Errorf("header %s is %q, expected %q", name, got, want)
+		}
+	}
+	if len(cfg.Experiment.Tags) != 1 || cfg.Experiment.Tags[0] != "true" {
+		t.Errorf("tags are %q", cfg.Experiment.Tags)
+	}
+}
+
+func TestInterpolateMissing(t *testing.T) {
+	_, err := Load(writeConfig(t, `
+targets:
+  - url: ${BENCH_UNSET_A}
+    body: ${BENCH_UNSET_B}
+`), false)
+	if err == nil || !strings.Contains(err.Error(), "BENCH_UNSET_A, BENCH_UNSET_B") {
+		t.Fatalf("expected the unset variables in the error, got %v", err)
+	}
+}
+
+func TestReadKeepsFileWithoutVariables(t *testing.T) {
+	text := "# comment\ntargets:\n  - url: http://hello.functions.example.com\n"
+	data, err := read(writeConfig(t, text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != text {
+		t.Errorf("read returned %q, expected the file as written", data)
+	}
+}
+
+func TestInterpolateKeepsMatrixParams(t *testing.T) {
+	t.Setenv("BENCH_HOST", "hello.functions.example.com")
+	_, runs, err := Expand(writeConfig(t, `
+matrix:
+  params:
+    rps: [10, 20]
+targets:
+  - url: "http://${BENCH_HOST}/"
+rate:
+  requestsPerSecond: ${matrix.rps}
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []float64{10, 20} {
+		cfg := runs[i].Config
+		if cfg.Rate.RequestsPerSecond != want || cfg.Targets[0].URL != "http://hello.functions.example.com/" {
+			t.Errorf("run %d has rate %v and url %q", i, cfg.Rate.RequestsPerSecond, cfg.Targets[0].URL)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expect are the rules a response to a target must meet, without them any 2xx response does
+type Expect struct {
+	// Status lists the allowed status codes, any 2xx by default
+	Status []int `yaml:"status,omitempty"`
+	// Body is a regular expression the body must match
+	Body string `yaml:"body,omitempty"`
+	// JSON maps paths into the JSON body, like $.items[0].id, to the value they must have
+	JSON map[string]interface{} `yaml:"json,omitempty"`
+	// Headers must be in the response, with the given value unless it is empty
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// MaxLatency is the longest a response may take in total
+	MaxLatency Duration `yaml:"maxLatency,omitempty"`
+
+	body  *regexp.Regexp
+	paths map[string][]pathStep
+}
+
+// StatusError is returned by Check for a response whose status is not allowed
+type StatusError struct {
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status %d is not expected", e.Status)
+}
+
+// pathStep is a key of an object or an index of an array in a JSON path
+type pathStep struct {
+	key   string
+	index int
+}
+
+// compileExpectations parses the body regular expressions and the JSON paths of the targets
+func compileExpectations(targets []*Target) []Problem {
+	var problems []Problem
+	for i, t := range targets {
+		if t == nil || t.Expect == nil {
+			continue
+		}
+		e := t.Expect
+		path := fmt.Sprintf("targets[%d].expect", i)
+		if e.Body != "" {
+			re, err := regexp.Compile(e.Body)
+			if err != nil {
+				problems = append(problems, Problem{Path: path + ".body", Message: err.Error()})
+			}
+			e.body = re
+		}
+		e.paths = make(map[string][]pathStep, len(e.JSON))
+		for _, p := range sortedKeys(e.JSON) {
+			steps, err := parsePath(p)
+			if err != nil {
+				problems = append(problems, Problem{Path: path + ".json." + p, Message: err.Error()})
+				continue
+			}
+			e.paths[p] = steps
+		}
+	}
+	return problems
+}
+
+// parsePath splits a path like $.items[0].id, the leading $ is optional
+func parsePath(p string) ([]pathStep, error) {
+	rest := strings.TrimPrefix(p, "$")
+	if rest != p && rest != "" && rest[0] != '.' && rest[0] != '[' {
+		return nil, fmt.Errorf("%q is not a path like $.items[0].id", p)
+	}
+	if rest == p && !strings.HasPrefix(rest, "[") {
+		rest = "." + rest
+	}
+	var steps []pathStep
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("%q has an empty key", p)
+			}
+			steps = append(steps, pathStep{key: rest[1:end], index: -1})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%q has an unclosed [", p)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("%q has an invalid index %q", p, rest[1:end])
+			}
+			steps = append(steps, pathStep{index: index})
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("%q is not a path like $.items[0].id", p)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%q selects nothing", p)
+	}
+	return steps, nil
+}
+
+// Check returns why a response to the target does not meet its expectations,
+// nil if it does. A status that is not allowed is a *StatusError.
+func (t *Target) Check(resp *http.Response, body []byte, latency time.Duration) error {
+	e := t.Expect
+	if e == nil {
+		e = &Expect{}
+	}
+	if !e.allows(resp.StatusCode) {
+		return &StatusError{Status: resp.StatusCode}
+	}
+
+	var failures []string
+	for _, name := range sortedKeys(e.Headers) {
+		values := resp.Header.Values(name)
+		want := e.Headers[name]
+		switch {
+		case len(values) == 0:
+			failures = append(failures, fmt.Sprintf("header %s is missing", name))
+		case want != "" && values[0] != want:
+			failures = append(failures, fmt.Sprintf("header %s is %q, expected %q", name, values[0], want))
+		}
+	}
+	if e.body != nil && !e.body.Match(body) {
+		failures = append(failures, fmt.Sprintf("body does not match %q", e.Body))
+	}
+	if len(e.paths) > 0 {
+		var doc interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err != nil {
+			failures = append(failures, fmt.Sprintf("body is not JSON: %v", err))
+		} else {
+			for _, p := range sortedKeys(e.JSON) {
+				got, ok := lookup(doc, e.paths[p])
+				switch {
+				case !ok:
+					failures = append(failures, fmt.Sprintf("%s is missing", p))
+				case !equalJSON(got, e.JSON[p]):
+					failures = append(failures, fmt.Sprintf("%s is %v, expected %v", p, got, e.JSON[p]))
+				}
+			}
+		}
+	}
+	if e.MaxLatency.Duration > 0 && latency > e.MaxLatency.Duration {
+		failures = append(failures, fmt.Sprintf("latency %s is above %s", latency, e.MaxLatency.Duration))
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (e *Expect) allows(status int) bool {
+	if len(e.Status) == 0 {
+		return status >= http.StatusOK && status < http.StatusMultipleChoices
+	}
+	for _, s := range e.Status {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func lookup(doc interface{}, steps []pathStep) (interface{}, bool) {
+	for _, step := range steps {
+		if step.index < 0 {
+			object, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = object[step.key]; !ok {
+				return nil, false
+			}
+			continue
+		}
+		array, ok := doc.([]interface{})
+		if !ok || step.index >= len(array) {
+			return nil, false
+		}
+		doc = array[step.index]
+	}
+	return doc, true
+}
+
+// equalJSON compares a decoded JSON value with a scalar from the config, numbers by value
+func equalJSON(got, want interface{}) bool {
+	if n, ok := got.(json.Number); ok {
+		g, err := n.Float64()
+		if err != nil {
+			return false
+		}
+		w, ok := number(want)
+		return ok && g == w
+	}
+	switch want.(type) {
+	case string, bool, nil:
+		return got == want
+	}
+	return false
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
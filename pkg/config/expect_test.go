@@ -0,0 +1,142 @@
+package config
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []pathStep
+		wantErr string
+	}{
+		{path: "$.items[0].id", want: []pathStep{{key: "items", index: -1}, {index: 0}, {key: "id", index: -1}}},
+		{path: "items[2]", want: []pathStep{{key: "items", index: -1}, {index: 2}}},
+		{path: "$[1]", want: []pathStep{{index: 1}}},
+		{path: "[1].name", want: []pathStep{{index: 1}, {key: "name", index: -1}}},
+		{path: "$", wantErr: "selects nothing"},
+		{path: "$items", wantErr: "is not a path"},
+		{path: "$..id", wantErr: "empty key"},
+		{path: "$.items[0", wantErr: "unclosed ["},
+		{path: "$.items[-1]", wantErr: "invalid index"},
+		{path: "$.items[x]", wantErr: "invalid index"},
+		{path: "$.items[0]id", wantErr: "is not a path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			steps, err := parsePath(tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v and %v, expected an error about %q", steps, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(steps, tt.want) {
+				t.Errorf("got %+v, expected %+v", steps, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	const body = `{"items": [{"id": 7, "name": "a"}], "ok": true, "ratio": 0.5, "missing": null}`
+	tests := []struct {
+		name   string
+		expect *Expect
+		status int
+		header http.Header
+		// wantStatus is a status the check rejects as a *StatusError
+		wantStatus int
+		// wantErr are parts of the failures, empty if the response meets the expectations
+		wantErr []string
+	}{
+		{name: "default allows 2xx", status: http.StatusNoContent},
+		{name: "default rejects 3xx", status: http.StatusFound, wantStatus: http.StatusFound},
+		{name: "default rejects 5xx", status: http.StatusServiceUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "listed status", expect: &Expect{Status: []int{200, 404}}, status: http.StatusNotFound},
+		{name: "unlisted status", expect: &Expect{Status: []int{200, 404}}, status: http.StatusCreated, wantStatus: http.StatusCreated},
+		{name: "body matches", expect: &Expect{Body: `"name": "a"`}, status: http.StatusOK},
+		{name: "body does not match", expect: &Expect{Body: `^\[`}, status: http.StatusOK, wantErr: []string{"body does not match"}},
+		{
+			name:   "json paths match",
+			expect: &Expect{JSON: map[string]interface{}{"$.items[0].id": 7, "items[0].name": "a", "$.ok": true, "$.ratio": 0.5, "$.missing": nil}},
+			status: http.StatusOK,
+		},
+		{
+			name:    "json paths do not match",
+			expect:  &Expect{JSON: map[string]interface{}{"$.items[0].id": "7", "$.items[1].id": 8, "$.ok": false}},
+			status:  http.StatusOK,
+			wantErr: []string{"$.items[0].id is 7, expected 7", "$.items[1].id is missing", "$.ok is true, expected false"},
+		},
+		{name: "headers", expect: &Expect{Headers: map[string]string{"X-Served-By": "", "Content-Type": "application/json"}}, status: http.StatusOK,
+			header: http.Header{"X-Served-By": {"pod-1"}, "Content-Type": {"application/json"}}},
+		{name: "header missing or different", expect: &Expect{Headers: map[string]string{"X-Served-By": "", "Content-Type": "text/plain"}}, status: http.StatusOK,
+			header: http.Header{"Content-Type": {"application/json"}}, wantErr: []string{"header Content-Type is \"application/json\"", "header X-Served-By is missing"}},
+		{name: "latency", expect: &Expect{MaxLatency: Duration{Duration: time.Millisecond}}, status: http.StatusOK, wantErr: []string{"latency 5ms is above 1ms"}},
+		// The status is checked first, the other rules only judge an allowed response
+		{name: "status before body", expect: &Expect{Body: "nothing"}, status: http.StatusBadGateway, wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &Target{URL: "http://hello.functions.example.com", Expect: tt.expect}
+			if problems := compileExpectations([]*Target{target}); len(problems) > 0 {
+				t.Fatal(problems)
+			}
+			resp := &http.Response{StatusCode: tt.status, Header: tt.header}
+
+			err := target.Check(resp, []byte(body), 5*time.Millisecond)
+			var statusErr *StatusError
+			switch {
+			case tt.wantStatus != 0:
+				if !errors.As(err, &statusErr) || statusErr.Status != tt.wantStatus {
+					t.Errorf("got %v, expected status %d to be rejected", err, tt.wantStatus)
+				}
+			case len(tt.wantErr) == 0:
+				if err != nil {
+					t.Errorf("got %v", err)
+				}
+			default:
+				if err == nil || errors.As(err, &statusErr) {
+					t.Fatalf("got %v, expected failures %q", err, tt.wantErr)
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("%q lacks %q", err, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCheckBodyIsNotJSON(t *testing.T) {
+	target := &Target{URL: "http://hello.functions.example.com", Expect: &Expect{JSON: map[string]interface{}{"$.id": 1}}}
+	if problems := compileExpectations([]*Target{target}); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	err := target.Check(&http.Response{StatusCode: http.StatusOK}, []byte("hello"), 0)
+	if err == nil || !strings.Contains(err.Error(), "body is not JSON") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCompileExpectationsReportsMalformedPaths(t *testing.T) {
+	targets := []*Target{{URL: "http://hello.functions.example.com", Expect: &Expect{Body: "(", JSON: map[string]interface{}{"$.items[": 1}}}}
+	problems := compileExpectations(targets)
+	var paths []string
+	for _, p := range problems {
+		paths = append(paths, p.Path)
+	}
+	want := []string{"targets[0].expect.body", "targets[0].expect.json.$.items["}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("problems at %q, expected %q", paths, want)
+	}
+}
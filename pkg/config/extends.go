@@ -0,0 +1,206 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A config file can build on others:
+//
+//	extends: base.yaml            # one parent
+//	include: [client.yaml, s3.yaml] # fragments merged on top of the parent, in order
+//
+// The file itself is merged last. Maps merge key by key, scalars and lists
+// replace what they inherit, a list under "key+" is appended to the inherited
+// one instead and a null removes the inherited key. Paths are relative to the file.
+const (
+	keyExtends = "extends"
+	keyInclude = "include"
+	appendMark = "+"
+)
+
+// read returns the config file at path with its environment variables
+// interpolated and the files it extends or includes merged in. A file that
+// neither extends nor includes nor uses environment variables is returned as
+// written, so errors keep their line numbers.
+func read(path string) ([]byte, error) {
+	data, doc, err := resolve(path, nil)
+	if err != nil || data != nil {
+		return data, err
+	}
+	return yaml.Marshal(doc)
+}
+
+// resolve reads path and merges its parents, chain holds the files that led to
+// it. It returns the file as written too, unless it was changed by the merge or
+// the interpolation.
+func resolve(path string, chain []string) ([]byte, yaml.MapSlice, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range chain {
+		if p == abs {
+			return nil, nil, fmt.Errorf("%s extends or includes itself via %s", path, strings.Join(chain, " -> "))
+		}
+	}
+	chain = append(chain, abs)
+	// Problems of the file that was asked for are reported without its name, as before
+	wrap := func(err error) error {
+		if len(chain) == 1 {
+			return err
+		}
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, wrap(err)
+	}
+	changed, err := interpolate(doc)
+	if err != nil {
+		return nil, nil, wrap(err)
+	}
+
+	parents, doc, err := parentsOf(doc)
+	if err != nil {
+		return nil, nil, wrap(err)
+	}
+	if len(parents) == 0 {
+		if changed {
+			data = nil
+		}
+		return data, doc, nil
+	}
+	var merged yaml.MapSlice
+	for _, parent := range parents {
+		if !filepath.IsAbs(parent) {
+			parent = filepath.Join(filepath.Dir(path), parent)
+		}
+		_, parentDoc, err := resolve(parent, chain)
+		if err != nil {
+			return nil, nil, err
+		}
+		merged = merge(merged, parentDoc)
+	}
+	return nil, merge(merged, doc), nil
+}
+
+// parentsOf removes extends and include from doc and returns the files they
+// name, the parent first and the includes after it
+func parentsOf(doc yaml.MapSlice) ([]string, yaml.MapSlice, error) {
+	var extends, include []string
+	rest := make(yaml.MapSlice, 0, len(doc))
+	for _, item := range doc {
+		var err error
+		switch item.Key {
+		case keyExtends:
+			var parent string
+			if parent, err = fileName(item.Value); parent != "" {
+				extends = []string{parent}
+			}
+		case keyInclude:
+			include, err = fileNames(item.Value)
+		default:
+			rest = append(rest, item)
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", item.Key, err)
+		}
+	}
+	return append(extends, include...), rest, nil
+}
+
+func fileName(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("expected a file name, got %v", v)
+	}
+}
+
+func fileNames(v interface{}) ([]string, error) {
+	items, ok := v.([]interface{})
+	if !ok {
+		name, err := fileName(v)
+		if name == "" {
+			return nil, err
+		}
+		return []string{name}, err
+	}
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		name, err := fileName(item)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// merge returns base with over merged on top, neither is modified
+func merge(base, over yaml.MapSlice) yaml.MapSlice {
+	merged := make(yaml.MapSlice, len(base), len(base)+len(over))
+	copy(merged, base)
+	index := func(key string) int {
+		for i, item := range merged {
+			if fmt.Sprint(item.Key) == key {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, item := range over {
+		key := fmt.Sprint(item.Key)
+		appending := strings.HasSuffix(key, appendMark) && len(key) > len(appendMark)
+		if appending {
+			key = strings.TrimSuffix(key, appendMark)
+		}
+		i := index(key)
+		if i < 0 {
+			if item.Value != nil {
+				merged = append(merged, yaml.MapItem{Key: key, Value: item.Value})
+			}
+			continue
+		}
+
+		inherited := merged[i].Value
+		switch value := item.Value.(type) {
+		case nil:
+			merged = append(merged[:i], merged[i+1:]...)
+			continue
+		case yaml.MapSlice:
+			if m, ok := inherited.(yaml.MapSlice); ok {
+				merged[i].Value = merge(m, value)
+				continue
+			}
+		case []interface{}:
+			if list, ok := inherited.([]interface{}); ok && appending {
+				merged[i].Value = append(append([]interface{}{}, list...), value...)
+				continue
+			}
+		}
+		merged[i].Value = item.Value
+	}
+	return merged
+}
+
+// Render returns the config file at path as it is loaded, with its environment
+// variables interpolated and the files it extends or includes merged in
+func Render(path string) ([]byte, error) {
+	return read(path)
+}
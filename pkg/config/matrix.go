@@ -0,0 +1,234 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Matrix expands one config file into a run per combination of its params.
+// Every ${matrix.<param>} in the file is replaced by the value of the run, so
+// params can go into URLs, the rate, the experiment name or anywhere else:
+//
+//	matrix:
+//	  cooldown: 3m
+//	  params:
+//	    rps: 100..1000 step 100
+//	    language: [go, rust, ts]
+//
+// Params vary in order, the last one fastest.
+type Matrix struct {
+	// Cooldown is the pause between two runs
+	Cooldown Duration   `yaml:"cooldown"`
+	Params   Dimensions `yaml:"params"`
+}
+
+// Dimension is one param of a matrix with the values it takes
+type Dimension struct {
+	Name   string
+	Values []string
+}
+
+// Dimensions keep the order the params are written in
+type Dimensions []Dimension
+
+// UnmarshalYAML reads each param as a list of values, a single value or a
+// range "from..to" with an optional "step n" (1 by default)
+func (d *Dimensions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var params yaml.MapSlice
+	if err := unmarshal(&params); err != nil {
+		return err
+	}
+	for _, param := range params {
+		name := fmt.Sprint(param.Key)
+		values, err := dimensionValues(param.Value)
+		if err != nil {
+			return fmt.Errorf("matrix param %s: %w", name, err)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("matrix param %s has no values", name)
+		}
+		*d = append(*d, Dimension{Name: name, Values: values})
+	}
+	return nil
+}
+
+func (d Dimensions) MarshalYAML() (interface{}, error) {
+	params := make(yaml.MapSlice, len(d))
+	for i, dim := range d {
+		params[i] = yaml.MapItem{Key: dim.Name, Value: dim.Values}
+	}
+	return params, nil
+}
+
+var matrixRange = regexp.MustCompile(`^\s*(-?[0-9.]+)\s*\.\.\s*(-?[0-9.]+)(?:\s+step\s+([0-9.]+))?\s*$`)
+
+func dimensionValues(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, value := range v {
+			values[i] = fmt.Sprint(value)
+		}
+		return values, nil
+	case string:
+		if m := matrixRange.FindStringSubmatch(v); m != nil {
+			return expandRange(m[1], m[2], m[3])
+		}
+		return []string{v}, nil
+	case nil:
+		return nil, nil
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// maxRangeValues guards against a step that is much too small
+const maxRangeValues = 10000
+
+func expandRange(fromText, toText, stepText string) ([]string, error) {
+	from, err := strconv.ParseFloat(fromText, 64)
+	if err != nil {
+		return nil, err
+	}
+	to, err := strconv.ParseFloat(toText, 64)
+	if err != nil {
+		return nil, err
+	}
+	step := 1.0
+	if stepText != "" {
+		if step, err = strconv.ParseFloat(stepText, 64); err != nil {
+			return nil, err
+		}
+	}
+	if step <= 0 || to < from {
+		return nil, fmt.Errorf("range %s..%s needs from <= to and a positive step", fromText, toText)
+	}
+
+	var values []string
+	// Multiplying instead of adding keeps 0.1 steps from drifting
+	for i := 0; ; i++ {
+		v := from + float64(i)*step
+		if v > to+step*1e-9 {
+			break
+		}
+		if len(values) == maxRangeValues {
+			return nil, fmt.Errorf("range %s..%s has more than %d values", fromText, toText, maxRangeValues)
+		}
+		values = append(values, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return values, nil
+}
+
+// Run is one expansion of a matrix
+type Run struct {
+	// Index counts the runs from 0 in the order they run
+	Index int
+	// Params holds the value of every matrix param in this run
+	Params map[string]string
+	Config *Config
+}
+
+// Name lists the params of the run, e.g. rps=100,language=go
+func (r Run) Name(m *Matrix) string {
+	pairs := make([]string, len(m.Params))
+	for i, dim := range m.Params {
+		pairs[i] = dim.Name + "=" + r.Params[dim.Name]
+	}
+	return strings.Join(pairs, ",")
+}
+
+var matrixPlaceholder = regexp.MustCompile(`\$\{matrix\.([A-Za-z0-9_-]+)\}`)
+
+// Expand loads a config file with a matrix block and returns the matrix and
+// one config per combination of its params. The matrix params are added to
+// the experiment params of every run. A run that does not load fails the whole expansion.
+func Expand(path string, devMode bool) (*Matrix, []Run, error) {
+	data, err := read(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := readMatrix(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m == nil {
+		return nil, nil, fmt.Errorf("%s has no matrix block", path)
+	}
+
+	known := make(map[string]bool)
+	for _, dim := range m.Params {
+		known[dim.Name] = true
+	}
+	for _, match := range matrixPlaceholder.FindAllStringSubmatch(string(data), -1) {
+		if !known[match[1]] {
+			return nil, nil, fmt.Errorf("%s is not a matrix param", match[0])
+		}
+	}
+
+	var runs []Run
+	for _, params := range combinations(m.Params) {
+		text := matrixPlaceholder.ReplaceAllStringFunc(string(data), func(placeholder string) string {
+			return params[matrixPlaceholder.FindStringSubmatch(placeholder)[1]]
+		})
+		run := Run{Index: len(runs), Params: params}
+		cfg, err := parse([]byte(text), devMode)
+		if err != nil {
+			return nil, nil, fmt.Errorf("run %d (%s): %w", run.Index, run.Name(m), err)
+		}
+		cfg.Matrix = nil
+		if cfg.Experiment.Params == nil {
+			cfg.Experiment.Params = make(map[string]string)
+		}
+		for name, value := range params {
+			cfg.Experiment.Params[name] = value
+		}
+		run.Config = cfg
+		runs = append(runs, run)
+	}
+	return m, runs, nil
+}
+
+// readMatrix returns the matrix block of a config file, nil if there is none
+func readMatrix(data []byte) (*Matrix, error) {
+	var file struct {
+		Matrix *Matrix `yaml:"matrix"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return file.Matrix, nil
+}
+
+// combinations returns every combination of the values of dims, the last dimension varying fastest
+func combinations(dims Dimensions) []map[string]string {
+	combos := []map[string]string{{}}
+	for _, dim := range dims {
+		var next []map[string]string
+		for _, combo := range combos {
+			for _, value := range dim.Values {
+				c := make(map[string]string, len(combo)+1)
+				for k, v := range combo {
+					c[k] = v
+				}
+				c[dim.Name] = value
+				next = append(next, c)
+			}
+		}
+		combos = next
+	}
+	return combos
+}
+
+// IsMatrix reports whether the config file at path has a matrix block
+func IsMatrix(path string) (bool, error) {
+	data, err := read(path)
+	if err != nil {
+		return false, err
+	}
+	m, err := readMatrix(data)
+	return m != nil, err
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// HTTP methods of targets
+var methods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// loadPayloads reads the body files of the targets and generates their random bodies
+func loadPayloads(targets []*Target) []Problem {
+	var problems []Problem
+	for i, t := range targets {
+		if t == nil {
+			continue
+		}
+		switch {
+		case t.BodyFile != "":
+			data, err := os.ReadFile(t.BodyFile)
+			if err != nil {
+				problems = append(problems, Problem{Path: fmt.Sprintf("targets[%d].bodyFile", i), Message: err.Error()})
+				continue
+			}
+			t.payload = data
+		case t.BodySize > 0:
+			t.payload = make([]byte, t.BodySize)
+			if _, err := rand.Read(t.payload); err != nil {
+				problems = append(problems, Problem{Path: fmt.Sprintf("targets[%d].bodySize", i), Message: err.Error()})
+			}
+		}
+	}
+	return problems
+}
+
+// HasBody reports whether requests to the target carry a body
+func (t *Target) HasBody() bool {
+	return t.Body != "" || t.BodyFile != "" || t.BodySize > 0
+}
+
+// HTTPMethod returns the method of the target, GET or POST if it has a body when none is set
+func (t *Target) HTTPMethod() string {
+	switch {
+	case t.Method != "":
+		return t.Method
+	case t.HasBody():
+		return http.MethodPost
+	}
+	return http.MethodGet
+}
+
+// Payload returns the contents of BodyFile or the random bytes of BodySize,
+// nil if the body of the target is Body. It is shared by all requests and must not be changed.
+func (t *Target) Payload() []byte {
+	return t.payload
+}
+
+// ContentTypeOf returns the content type of the body of the target
+func (t *Target) ContentTypeOf() string {
+	switch {
+	case t.ContentType != "":
+		return t.ContentType
+	case t.payload != nil:
+		return "application/octet-stream"
+	}
+	return "application/json"
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Request is what the header and body templates of a target see, e.g.
+// {{.Seq}}, {{.UUID}}, {{.Now.UnixMilli}} or {{randInt 1 100}}
+type Request struct {
+	// Seq counts the requests to the target, from 1
+	Seq  uint64
+	UUID string
+	Now  time.Time
+}
+
+var templateFuncs = template.FuncMap{
+	// randInt returns a random int in [min, max]
+	"randInt": func(min, max int) (int, error) {
+		if max < min {
+			return 0, fmt.Errorf("randInt %d %d: max is below min", min, max)
+		}
+		return min + rand.Intn(max-min+1), nil
+	},
+}
+
+// targetTemplates are the parsed templates of a target, only the headers and
+// the body that contain {{ are executed per request
+type targetTemplates struct {
+	seq     atomic.Uint64
+	headers map[string]*template.Template
+	body    *template.Template
+}
+
+// compileTemplates parses the templates in the headers and the body of the targets
+func compileTemplates(targets []*Target) []Problem {
+	var problems []Problem
+	for i, t := range targets {
+		path := fmt.Sprintf("targets[%d]", i)
+		tt := &targetTemplates{headers: make(map[string]*template.Template)}
+		names := make([]string, 0, len(t.Headers))
+		for name := range t.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value := t.Headers[name]
+			if !strings.Contains(value, "{{") {
+				continue
+			}
+			tmpl, err := template.New(name).Funcs(templateFuncs).Parse(value)
+			if err != nil {
+				problems = append(problems, Problem{Path: path + ".headers." + name, Message: err.Error()})
+				continue
+			}
+			tt.headers[name] = tmpl
+		}
+		if strings.Contains(t.Body, "{{") {
+			tmpl, err := template.New("body").Funcs(templateFuncs).Parse(t.Body)
+			if err != nil {
+				problems = append(problems, Problem{Path: path + ".body", Message: err.Error()})
+			}
+			tt.body = tmpl
+		}
+		if len(tt.headers) > 0 || tt.body != nil {
+			t.templates = tt
+		}
+	}
+	return problems
+}
+
+// Templated reports whether the headers or the body of the target change per request
+func (t *Target) Templated() bool {
+	return t.templates != nil
+}
+
+// Render returns the headers and the body of the next request to the target
+// with their templates executed. Without templates they are returned as written.
+func (t *Target) Render() (map[string]string, string, error) {
+	if t.templates == nil {
+		return t.Headers, t.Body, nil
+	}
+	req := Request{
+		Seq:  t.templates.seq.Add(1),
+		UUID: uuid.NewString(),
+		Now:  time.Now().UTC(),
+	}
+	var sb strings.Builder
+	execute := func(tmpl *template.Template) (string, error) {
+		sb.Reset()
+		if err := tmpl.Execute(&sb, req); err != nil {
+			return "", err
+		}
+		return sb.String(), nil
+	}
+
+	headers := make(map[string]string, len(t.Headers))
+	for name, value := range t.Headers {
+		if tmpl, ok := t.templates.headers[name]; ok {
+			rendered, err := execute(tmpl)
+			if err != nil {
+				return nil, "", err
+			}
+			value = rendered
+		}
+		headers[name] = value
+	}
+	body := t.Body
+	if t.templates.body != nil {
+		rendered, err := execute(t.templates.body)
+		if err != nil {
+			return nil, "", err
+		}
+		body = rendered
+	}
+	return headers, body, nil
+}
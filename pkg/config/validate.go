@@ -0,0 +1,467 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+)
+
+// Modes of the workload generator, some checks of Validate depend on them
+const (
+	ModeRate       = "rate"
+	ModeEvent      = "event"
+	ModeColdStart  = "cold-start"
+	ModeTrace      = "trace"
+	ModeClosedLoop = "closed-loop"
+	ModeSearch     = "search"
+)
+
+// Problem is one thing wrong with a config, at the YAML path of the offending field
+type Problem struct {
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	return p.Path + ": " + p.Message
+}
+
+// ValidationError lists every problem Validate found
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = p.String()
+	}
+	return "invalid config:\n  " + strings.Join(lines, "\n  ")
+}
+
+// validator collects problems
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) add(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// oneOf checks value is one of allowed, empty always is and picks the default
+func (v *validator) oneOf(path, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.add(path, "%q is not one of %s", value, strings.Join(allowed, ", "))
+}
+
+func (v *validator) notNegativeDuration(path string, d time.Duration) {
+	if d < 0 {
+		v.add(path, "must not be negative, got %s", d)
+	}
+}
+
+func (v *validator) notNegative(path string, value float64) {
+	if value < 0 {
+		v.add(path, "must not be negative, got %v", value)
+	}
+}
+
+func (v *validator) positiveDuration(path string, d time.Duration) {
+	if d <= 0 {
+		v.add(path, "must be a positive duration, got %s", d)
+	}
+}
+
+func (v *validator) httpURL(path, raw string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		v.add(path, "%v", err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		v.add(path, "%q needs an http or https scheme", raw)
+	} else if u.Host == "" {
+		v.add(path, "%q has no host", raw)
+	}
+}
+
+// Validate checks the config for the given modes, ModeRate if there are none,
+// and returns a *ValidationError with every problem found
+func (c *Config) Validate(modes ...string) error {
+	if len(modes) == 0 {
+		modes = []string{ModeRate}
+	}
+	is := make(map[string]bool)
+	for _, mode := range modes {
+		is[mode] = true
+	}
+
+	v := &validator{}
+	c.validateTargets(v, is[ModeEvent])
+	if c.BaseURL != "" {
+		v.httpURL("baseUrl", c.BaseURL)
+	}
+	c.validateRate(v, is)
+	for i, p := range c.Phases {
+		validatePhase(v, fmt.Sprintf("phases[%d]", i), p)
+	}
+	if is[ModeTrace] {
+		c.validateTrace(v)
+	}
+	if is[ModeClosedLoop] {
+		c.validateClosedLoop(v)
+	}
+	if is[ModeColdStart] {
+		c.validateColdStart(v)
+	}
+	if is[ModeSearch] {
+		c.validateSearch(v)
+	}
+	validateStore(v, c.Store)
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+func (c *Config) validateTargets(v *validator, event bool) {
+	if len(c.Targets) == 0 {
+		v.add("targets", "needs at least one target")
+	}
+	// Weights only apply when a single target is picked per arrival
+	weighted := c.Rate.TargetSelection == SelectWeighted || c.Rate.TargetSelection == SelectSmooth
+	positive := slices.ContainsFunc(c.Targets, func(t *Target) bool { return t != nil && t.Weight > 0 })
+	if weighted && len(c.Targets) > 0 && !positive {
+		v.add("targets", "needs a target with a positive weight for rate.targetSelection %s", c.Rate.TargetSelection)
+	}
+	for i, t := range c.Targets {
+		path := fmt.Sprintf("targets[%d]", i)
+		if t == nil {
+			v.add(path, "is empty")
+			continue
+		}
+		if t.URL == "" {
+			v.add(path+".url", "is required")
+		} else {
+			v.httpURL(path+".url", t.URL)
+		}
+		if t.Weight < 0 {
+			v.add(path+".weight", "must not be negative, got %d", t.Weight)
+		}
+		if t.Weight == 0 && !weighted {
+			v.add(path+".weight", "0 only excludes the target with rate.targetSelection %s or %s, every target gets every arrival with %s", SelectWeighted, SelectSmooth, SelectAll)
+		}
+		v.oneOf(path+".type", t.Type, TargetHTTP, TargetGRPC)
+		if t.Expect != nil {
+			validateExpect(v, path+".expect", t.Expect)
+		}
+		if t.Type == TargetGRPC {
+			validateGRPC(v, path, t)
+			continue
+		}
+		if t.GRPC != nil {
+			v.add(path+".grpc", "only applies to grpc targets")
+		}
+		v.oneOf(path+".protocol", t.Protocol, ProtocolHTTP1, ProtocolH2, ProtocolH2C, ProtocolH3)
+		c.validateScheme(v, path, t)
+		v.oneOf(path+".method", t.Method, methods...)
+		validateBody(v, path, t)
+	}
+	// Only the first target is sent as a cloud event, to K_SINK
+	if event && len(c.Targets) > 0 && c.Targets[0] != nil {
+		if c.Targets[0].Type == TargetGRPC {
+			v.add("targets[0].type", "cloud events are sent over http")
+		}
+		if c.Targets[0].Method != "" {
+			v.add("targets[0].method", "cloud events are always sent with POST")
+		}
+		if c.Targets[0].BodyFile != "" || c.Targets[0].BodySize > 0 {
+			v.add("targets[0].body", "the data of cloud events is the inline body")
+		}
+		for _, header := range []string{"ce-type", "ce-source"} {
+			if c.Targets[0].Headers[header] == "" {
+				v.add("targets[0].headers."+header, "is required in event mode")
+			}
+		}
+	}
+}
+
+func validateGRPC(v *validator, path string, t *Target) {
+	if t.Protocol != "" {
+		v.add(path+".protocol", "does not apply to grpc targets, they use h2c for http URLs and TLS for https URLs")
+	}
+	if t.Method != "" || t.BodyFile != "" || t.BodySize != 0 || t.ContentType != "" {
+		v.add(path, "method, bodyFile, bodySize and contentType do not apply to grpc targets, their body is the request as JSON")
+	}
+	if t.GRPC == nil || t.GRPC.Method == "" {
+		v.add(path+".grpc.method", "is required for grpc targets")
+		return
+	}
+	service, method, ok := strings.Cut(strings.TrimPrefix(t.GRPC.Method, "/"), "/")
+	if !ok || service == "" || method == "" || strings.Contains(method, "/") {
+		v.add(path+".grpc.method", "%q is not of the form package.Service/Method", t.GRPC.Method)
+	}
+	if t.GRPC.DescriptorSet != "" {
+		if _, err := os.Stat(t.GRPC.DescriptorSet); err != nil {
+			v.add(path+".grpc.descriptorSet", "%v", err)
+		}
+	}
+}
+
+func validateExpect(v *validator, path string, e *Expect) {
+	for i, status := range e.Status {
+		if status < 100 || status > 599 {
+			v.add(fmt.Sprintf("%s.status[%d]", path, i), "%d is not an HTTP status", status)
+		}
+	}
+	for _, p := range sortedKeys(e.JSON) {
+		switch e.JSON[p].(type) {
+		case string, bool, nil, int, int64, uint64, float64:
+		default:
+			v.add(path+".json."+p, "must be a string, number, boolean or null")
+		}
+	}
+	for _, name := range sortedKeys(e.Headers) {
+		if strings.TrimSpace(name) == "" {
+			v.add(path+".headers", "has an empty header name")
+		}
+	}
+	v.notNegativeDuration(path+".maxLatency", e.MaxLatency.Duration)
+}
+
+// validateBody checks the target has at most one body
+func validateBody(v *validator, path string, t *Target) {
+	v.notNegative(path+".bodySize", float64(t.BodySize))
+	bodies := 0
+	for _, set := range []bool{t.Body != "", t.BodyFile != "", t.BodySize > 0} {
+		if set {
+			bodies++
+		}
+	}
+	if bodies > 1 {
+		v.add(path+".body", "only one of body, bodyFile and bodySize can be set")
+	}
+}
+
+// validateScheme checks the URL of t can be sent with its protocol
+func (c *Config) validateScheme(v *validator, path string, t *Target) {
+	u, err := url.Parse(t.URL)
+	if err != nil || t.URL == "" {
+		return
+	}
+	switch protocol := c.ProtocolOf(t); {
+	case protocol == ProtocolH2C && u.Scheme != "http":
+		v.add(path+".url", "h2c needs an http URL, got %q", t.URL)
+	case (protocol == ProtocolH2 || protocol == ProtocolH3) && u.Scheme != "https":
+		v.add(path+".url", "%s needs an https URL, got %q", protocol, t.URL)
+	}
+}
+
+func (c *Config) validateRate(v *validator, is map[string]bool) {
+	r := c.Rate
+	v.notNegative("rate.requestsPerSecond", r.RequestsPerSecond)
+	if is[ModeColdStart] && (r.RequestsPerSecond <= 0 || r.RequestsPerSecond >= 1) {
+		v.add("rate.requestsPerSecond", "must be between 0 and 1 in cold start mode, each arrival probes every target in turn, got %v", r.RequestsPerSecond)
+	}
+	// Phases, stages and traces bring their own durations
+	needsDuration := len(c.Phases) == 0 && !is[ModeTrace] && !is[ModeSearch] &&
+		!(is[ModeClosedLoop] && len(c.ClosedLoop.Stages) > 0)
+	if needsDuration {
+		v.positiveDuration("rate.duration", r.Duration.Duration)
+	}
+	v.notNegative("rate.maxIdleConns", float64(r.MaxIdleConns))
+	v.notNegative("rate.maxIdleConnsPerHost", float64(r.MaxIdleConnsPerHost))
+	v.notNegativeDuration("rate.idleConnTimeout", r.IdleConnTimeout)
+	v.notNegativeDuration("rate.timeout", r.Timeout)
+	v.oneOf("rate.targetSelection", r.TargetSelection, SelectAll, SelectWeighted, SelectSmooth)
+	v.oneOf("rate.protocol", r.Protocol, ProtocolHTTP1, ProtocolH2, ProtocolH2C, ProtocolH3)
+
+	a := r.Arrival
+	v.oneOf("rate.arrival.process", a.Process, ArrivalConstant, ArrivalPoisson, ArrivalUniform, ArrivalGamma)
+	if a.Process == ArrivalUniform && (a.Jitter < 0 || a.Jitter > 1) {
+		v.add("rate.arrival.jitter", "must be between 0 and 1, got %v", a.Jitter)
+	}
+	if a.Process == ArrivalGamma && a.CV <= 0 {
+		v.add("rate.arrival.cv", "must be positive for the gamma process, got %v", a.CV)
+	}
+}
+
+func validatePhase(v *validator, path string, p Phase) {
+	v.positiveDuration(path+".duration", p.Duration.Duration)
+	v.oneOf(path+".shape", p.Shape, ShapeConstant, ShapeRamp, ShapeStep, ShapeSpike, ShapeSine)
+	v.notNegative(path+".rate", p.Rate)
+	v.notNegative(path+".from", p.From)
+	v.notNegative(path+".to", p.To)
+	v.notNegative(path+".peak", p.Peak)
+	switch p.Shape {
+	case ShapeStep:
+		if p.Steps < 1 {
+			v.add(path+".steps", "step shape needs at least 1 step, got %d", p.Steps)
+		}
+	case ShapeSpike:
+		v.positiveDuration(path+".spikeDuration", p.SpikeDuration.Duration)
+		if p.SpikeAt.Duration < 0 || p.SpikeAt.Duration >= p.Duration.Duration {
+			v.add(path+".spikeAt", "must be within the phase duration %s, got %s", p.Duration.Duration, p.SpikeAt.Duration)
+		}
+	case ShapeSine:
+		v.positiveDuration(path+".period", p.Period.Duration)
+	}
+}
+
+func (c *Config) validateTrace(v *validator) {
+	tr := c.Trace
+	if tr == nil {
+		v.add("trace", "is required in trace mode")
+		return
+	}
+	if tr.Path == "" {
+		v.add("trace.path", "is required")
+	}
+	v.oneOf("trace.format", tr.Format, TraceAzure, TraceJSONL)
+	v.notNegative("trace.speedup", tr.Speedup)
+	v.notNegative("trace.startMinute", float64(tr.StartMinute))
+	v.notNegative("trace.minutes", float64(tr.Minutes))
+	v.oneOf("trace.spread", tr.Spread, SpreadUniform, SpreadEven)
+}
+
+func (c *Config) validateClosedLoop(v *validator) {
+	cl := c.ClosedLoop
+	if len(cl.Stages) == 0 && cl.Users <= 0 {
+		v.add("closedLoop.users", "must be positive without stages, got %d", cl.Users)
+	}
+	v.notNegativeDuration("closedLoop.thinkTime", cl.ThinkTime.Duration)
+	v.oneOf("closedLoop.thinkTimeDistribution", cl.ThinkTimeDistribution, ThinkConstant, ThinkExponential)
+	for i, stage := range cl.Stages {
+		path := fmt.Sprintf("closedLoop.stages[%d]", i)
+		v.notNegative(path+".users", float64(stage.Users))
+		v.positiveDuration(path+".duration", stage.Duration.Duration)
+	}
+}
+
+func (c *Config) validateColdStart(v *validator) {
+	cs := c.ColdStart
+	v.oneOf("coldStart.confirm", cs.Confirm, ConfirmNone, ConfirmReplicas, ConfirmIdle)
+	if cs.Confirm == ConfirmIdle {
+		v.positiveDuration("coldStart.idlePeriod", cs.IdlePeriod.Duration)
+	}
+	v.notNegativeDuration("coldStart.gap", cs.Gap.Duration)
+	v.notNegativeDuration("coldStart.pollInterval", cs.PollInterval.Duration)
+	v.notNegativeDuration("coldStart.timeout", cs.Timeout.Duration)
+}
+
+func (c *Config) validateSearch(v *validator) {
+	s := c.Search
+	v.notNegative("search.startRate", s.StartRate)
+	v.notNegative("search.maxRate", s.MaxRate)
+	if s.MaxRate > 0 && s.StartRate > s.MaxRate {
+		v.add("search.maxRate", "must not be below startRate %v, got %v", s.StartRate, s.MaxRate)
+	}
+	if s.StepFactor != 0 && s.StepFactor <= 1 {
+		v.add("search.stepFactor", "must be above 1, got %v", s.StepFactor)
+	}
+	if s.Precision < 0 || s.Precision >= 1 {
+		v.add("search.precision", "must be between 0 and 1, got %v", s.Precision)
+	}
+	v.notNegativeDuration("search.stageDuration", s.StageDuration.Duration)
+	v.notNegativeDuration("search.warmup", s.Warmup.Duration)
+	v.notNegativeDuration("search.cooldown", s.Cooldown.Duration)
+	v.notNegative("search.maxStages", float64(s.MaxStages))
+	if s.SLO.Percentile < 0 || s.SLO.Percentile > 100 {
+		v.add("search.slo.percentile", "must be between 0 and 100, got %v", s.SLO.Percentile)
+	}
+	if s.SLO.MaxErrorRate < 0 || s.SLO.MaxErrorRate > 1 {
+		v.add("search.slo.maxErrorRate", "must be a fraction between 0 and 1, got %v", s.SLO.MaxErrorRate)
+	}
+}
+
+func validateStore(v *validator, s store.Store) {
+	v.oneOf("store.sink", s.Sink, store.SinkJSONL, store.SinkCSV, store.SinkParquet, store.SinkSQLite)
+	if s.Sink == store.SinkSQLite && s.Path == "" {
+		v.add("store.path", "is required by the sqlite sink")
+	}
+	v.notNegative("store.buffer", float64(s.Buffer))
+	r := s.Rotation
+	v.notNegative("store.rotation.maxSizeMB", float64(r.MaxSizeMB))
+	if r.Interval != "" {
+		if d, err := time.ParseDuration(r.Interval); err != nil {
+			v.add("store.rotation.interval", "%v", err)
+		} else if d <= 0 {
+			v.add("store.rotation.interval", "must be positive, got %s", d)
+		}
+	}
+	v.oneOf("store.rotation.compress", r.Compress, store.CompressGzip, store.CompressZstd)
+}
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// unknownFields returns a problem for every key in doc that t has no field for
+func unknownFields(path string, doc interface{}, t reflect.Type) []Problem {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Types that read themselves decide what they accept
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		return nil
+	}
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+
+	var problems []Problem
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := doc.(yaml.MapSlice)
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			fields[name] = t.Field(i).Type
+		}
+		for _, item := range m {
+			key := fmt.Sprint(item.Key)
+			field, ok := fields[key]
+			if !ok {
+				problems = append(problems, Problem{Path: join(key), Message: "unknown field"})
+				continue
+			}
+			problems = append(problems, unknownFields(join(key), item.Value, field)...)
+		}
+	case reflect.Map:
+		if m, ok := doc.(yaml.MapSlice); ok {
+			for _, item := range m {
+				problems = append(problems, unknownFields(join(fmt.Sprint(item.Key)), item.Value, t.Elem())...)
+			}
+		}
+	case reflect.Slice:
+		if items, ok := doc.([]interface{}); ok {
+			for i, item := range items {
+				problems = append(problems, unknownFields(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+			}
+		}
+	}
+	return problems
+}
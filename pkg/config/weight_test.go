@@ -0,0 +1,50 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWeights(t *testing.T) {
+	tests := []struct {
+		name      string
+		selection string
+		weights   string
+		want      []int
+		// wantErr is part of the validation error, empty if the config is valid
+		wantErr string
+	}{
+		{name: "missing weights are 1", selection: SelectWeighted, weights: "-,-", want: []int{1, 1}},
+		{name: "zero excludes a target", selection: SelectSmooth, weights: "3,0", want: []int{3, 0}},
+		{name: "all zero", selection: SelectWeighted, weights: "0,0", want: []int{0, 0}, wantErr: "needs a target with a positive weight"},
+		{name: "zero with every target", selection: SelectAll, weights: "-,0", want: []int{1, 0}, wantErr: "targets[1].weight: 0 only excludes the target"},
+		{name: "default selection ignores weights", weights: "5,-", want: []int{5, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := "rate:\n  requestsPerSecond: 10\n  duration: 10s\n  targetSelection: \"" + tt.selection + "\"\ntargets:\n"
+			for i, weight := range strings.Split(tt.weights, ",") {
+				text += "  - url: http://hello" + string(rune('a'+i)) + ".functions.example.com\n"
+				if weight != "-" {
+					text += "    weight: " + weight + "\n"
+				}
+			}
+			cfg, err := Load(writeConfig(t, text), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.want {
+				if cfg.Targets[i].Weight != want {
+					t.Errorf("target %d has weight %d, expected %d", i, cfg.Targets[i].Weight, want)
+				}
+			}
+			err = cfg.Validate(ModeRate)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("expected an error with %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
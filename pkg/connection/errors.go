@@ -0,0 +1,146 @@
+package connection
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Kinds of request errors
+const (
+	// KindDNS is a failed lookup of the host
+	KindDNS = "dns"
+	// KindDialRefused is a connection refused by the host
+	KindDialRefused = "dial_refused"
+	// KindDialTimeout is a connection that was not established in time
+	KindDialTimeout = "dial_timeout"
+	// KindTLS is a failed TLS handshake, including bad certificates
+	KindTLS = "tls"
+	// KindRequestTimeout is a request that timed out while it was written or the body was read
+	KindRequestTimeout = "request_timeout"
+	// KindHeaderTimeout is a request that was written but timed out waiting for the response headers
+	KindHeaderTimeout = "header_timeout"
+	// KindBodyRead is a response whose body could not be read
+	KindBodyRead = "body_read"
+	// KindCanceled is a request whose context was cancelled, e.g. at the end of a run
+	KindCanceled = "canceled"
+	// KindReset is a connection closed or reset by the other side
+	KindReset = "reset"
+	// KindOther is any other error
+	KindOther = "other"
+)
+
+// Error is a failed request and the kind of its failure
+type Error struct {
+	Kind string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns the kind of err, the one it was wrapped with or else the one it is classified as
+func KindOf(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return classify(err, stepNone)
+}
+
+// Steps of a request, from the client trace, that tell where a timeout happened
+const (
+	stepNone int32 = iota
+	stepDNS
+	stepConnect
+	stepTLS
+	stepWrote
+	stepResponse
+)
+
+// classify returns the kind of err, step is the part of the request that was running when it failed
+func classify(err error, step int32) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return KindCanceled
+	case errors.As(err, &dnsErr):
+		return KindDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return KindDialRefused
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		switch step {
+		case stepDNS:
+			return KindDNS
+		case stepConnect:
+			return KindDialTimeout
+		case stepTLS:
+			return KindTLS
+		case stepWrote:
+			return KindHeaderTimeout
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return KindDialTimeout
+		}
+		return KindRequestTimeout
+	case step == stepTLS || isTLS(err):
+		return KindTLS
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE):
+		return KindReset
+	}
+	if st, ok := status.FromError(err); ok {
+		return classifyGRPC(st)
+	}
+	return KindOther
+}
+
+func isTLS(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// classifyGRPC classifies the status of a failed grpc call. grpc flattens
+// connection errors into the status message, so they are told apart by it.
+func classifyGRPC(st *status.Status) string {
+	msg := st.Message()
+	switch {
+	case st.Code() == codes.Canceled:
+		return KindCanceled
+	case st.Code() == codes.DeadlineExceeded:
+		return KindRequestTimeout
+	case strings.Contains(msg, "no such host") || strings.Contains(msg, "lookup "):
+		return KindDNS
+	case strings.Contains(msg, "connection refused"):
+		return KindDialRefused
+	case strings.Contains(msg, "tls:") || strings.Contains(msg, "x509:") || strings.Contains(msg, "authentication handshake failed"):
+		return KindTLS
+	case strings.Contains(msg, "i/o timeout"):
+		return KindDialTimeout
+	case strings.Contains(msg, "EOF") || strings.Contains(msg, "connection reset") ||
+		strings.Contains(msg, "broken pipe") || strings.Contains(msg, "connection closed"):
+		return KindReset
+	}
+	return KindOther
+}
@@ -0,0 +1,180 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+func TestSendErrorKinds(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		case "/reset":
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	// The certificate of tlsServer is not trusted by the pool
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.Config.ErrorLog = log.New(io.Discard, "", 0)
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	h3URL := startH3(t, tlsServer, handler)
+	// Nothing listens on a port that was just closed
+	closed := httptest.NewServer(handler)
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		protocol string
+		// want is the kind of the error, empty if the request gets a response
+		want string
+	}{
+		{name: "dns", url: "http://hello.functions.invalid/", want: KindDNS},
+		{name: "refused", url: closed.URL + "/", want: KindDialRefused},
+		{name: "tls", url: tlsServer.URL + "/", want: KindTLS},
+		{name: "tls over h3", url: h3URL + "/", protocol: config.ProtocolH3, want: KindTLS},
+		{name: "header timeout", url: server.URL + "/slow", want: KindHeaderTimeout},
+		{name: "reset", url: server.URL + "/reset", want: KindReset},
+		// A status, even a 5xx, is a response and the generator judges it by the expectations
+		{name: "http status", url: server.URL + "/unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPool("", 10, 10, time.Minute, 200*time.Millisecond, "")
+			target := &config.Target{URL: tt.url, Protocol: tt.protocol}
+
+			metrics, err := p.Send(target)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				metrics.Response.Body.Close()
+				if metrics.Response.StatusCode != http.StatusServiceUnavailable {
+					t.Errorf("status is %d", metrics.Response.StatusCode)
+				}
+				return
+			}
+			if err == nil {
+				metrics.Response.Body.Close()
+				t.Fatalf("got status %d, expected a %s error", metrics.Response.StatusCode, tt.want)
+			}
+			if kind := KindOf(err); kind != tt.want {
+				t.Errorf("kind of %v is %s, expected %s", err, kind, tt.want)
+			}
+		})
+	}
+}
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		step int32
+		want string
+	}{
+		{name: "canceled", err: context.Canceled, want: KindCanceled},
+		{name: "deadline while resolving", err: context.DeadlineExceeded, step: stepDNS, want: KindDNS},
+		{name: "deadline while connecting", err: context.DeadlineExceeded, step: stepConnect, want: KindDialTimeout},
+		{name: "deadline in the handshake", err: context.DeadlineExceeded, step: stepTLS, want: KindTLS},
+		{name: "deadline waiting for headers", err: context.DeadlineExceeded, step: stepWrote, want: KindHeaderTimeout},
+		{name: "deadline reading the body", err: context.DeadlineExceeded, step: stepResponse, want: KindRequestTimeout},
+		{name: "dial timeout", err: &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, want: KindDialTimeout},
+		{name: "read timeout", err: &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, want: KindRequestTimeout},
+		{name: "handshake failure", err: errors.New("remote error"), step: stepTLS, want: KindTLS},
+		{name: "broken pipe", err: &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, want: KindReset},
+		{name: "grpc status", err: status.Error(codes.Unavailable, "connection error: desc = \"transport: Error while dialing: dial tcp 127.0.0.1:1: connect: connection refused\""), want: KindDialRefused},
+		{name: "other", err: errors.New("something else"), want: KindOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind := classify(tt.err, tt.step); kind != tt.want {
+				t.Errorf("kind of %v is %s, expected %s", tt.err, kind, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyGRPC(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		msg  string
+		want string
+	}{
+		{code: codes.Canceled, msg: "context canceled", want: KindCanceled},
+		{code: codes.DeadlineExceeded, msg: "context deadline exceeded", want: KindRequestTimeout},
+		{code: codes.Unavailable, msg: "name resolver error: produced zero addresses", want: KindOther},
+		{code: codes.Unavailable, msg: "dial tcp: lookup hello.functions.invalid: no such host", want: KindDNS},
+		{code: codes.Unavailable, msg: "dial tcp 127.0.0.1:1: connect: connection refused", want: KindDialRefused},
+		{code: codes.Unavailable, msg: "authentication handshake failed: tls: failed to verify certificate: x509: certificate signed by unknown authority", want: KindTLS},
+		{code: codes.Unavailable, msg: "dial tcp 10.0.0.1:443: i/o timeout", want: KindDialTimeout},
+		{code: codes.Unavailable, msg: "error reading from server: EOF", want: KindReset},
+		{code: codes.Unavailable, msg: "read: connection reset by peer", want: KindReset},
+		{code: codes.Internal, msg: "unexpected EOF", want: KindReset},
+		{code: codes.Unknown, msg: "handler panicked", want: KindOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code.String()+"/"+tt.msg, func(t *testing.T) {
+			if kind := classifyGRPC(status.New(tt.code, tt.msg)); kind != tt.want {
+				t.Errorf("kind is %s, expected %s", kind, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvokeErrorKinds(t *testing.T) {
+	// Nothing listens on a port that was just closed
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{name: "refused", url: "http://" + lis.Addr().String(), want: KindDialRefused},
+		{name: "dns", url: "http://hello.functions.invalid:50051", want: KindDNS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPool("", 10, 10, time.Minute, time.Second, "")
+			target := &config.Target{URL: tt.url, GRPC: &config.GRPC{Method: healthCheck, DescriptorSet: writeHealthDescriptorSet(t)}}
+
+			if _, err := p.Invoke(target); KindOf(err) != tt.want {
+				t.Errorf("kind of %v is %s, expected %s", err, KindOf(err), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,481 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// grpcTarget is the connection of a grpc target and the method it calls
+type grpcTarget struct {
+	conn   *grpc.ClientConn
+	method protoreflect.MethodDescriptor
+	// name is the method as it goes on the wire, /package.Service/Method
+	name string
+
+	// setup holds the timings of the last connection until a call claims them
+	mu    sync.Mutex
+	setup connSetup
+}
+
+// connSetup are the timings of opening a connection, the call that waited for it reports them
+type connSetup struct {
+	dns, connect, tls time.Duration
+}
+
+// Invoke makes the unary call of a grpc target. The body of the target is the
+// request as JSON, its headers are sent as metadata. The reply comes back as
+// JSON in the body of a synthesized HTTP/2 response whose status is mapped from
+// the grpc status, so calls that got an answer are no error, as with Get. A call
+// past its deadline is a timeout error, even if its headers came back.
+func (p *pool) Invoke(target *config.Target) (*ResponseMetrics, error) {
+	p.count(target)
+	gt, err := p.grpcTarget(target)
+	if err != nil {
+		return nil, &Error{Kind: classify(err, stepNone), Err: err}
+	}
+	headers, body, err := target.Render()
+	if err != nil {
+		return nil, err
+	}
+	req := dynamicpb.NewMessage(gt.method.Input())
+	if strings.TrimSpace(body) != "" {
+		if err := protojson.Unmarshal([]byte(body), req); err != nil {
+			return nil, fmt.Errorf("request of %s: %w", gt.name, err)
+		}
+	}
+	reply := dynamicpb.NewMessage(gt.method.Output())
+
+	timing := &callTiming{}
+	ctx := context.WithValue(context.Background(), callTimingKey{}, timing)
+	ctx = metadata.NewOutgoingContext(ctx, outgoingMetadata(headers))
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	timing.start(start)
+	var header metadata.MD
+	err = gt.conn.Invoke(ctx, gt.name, req, reply, grpc.Header(&header))
+	metrics := &ResponseMetrics{
+		TTFB:       timing.ttfb(),
+		Total:      time.Since(start),
+		GRPCStatus: status.New(codes.OK, ""),
+	}
+	setup := gt.claimSetup()
+	metrics.DNSTime, metrics.ConnectTime, metrics.TLSTime = setup.dns, setup.connect, setup.tls
+	if err != nil {
+		metrics.GRPCStatus = status.Convert(err)
+	}
+	if err != nil && (metrics.TTFB == 0 || status.Code(err) == codes.DeadlineExceeded) {
+		// Nothing or not all came back, like a failed HTTP request
+		return metrics, &Error{Kind: classify(err, stepNone), Err: err}
+	}
+
+	st := metrics.GRPCStatus
+	var out []byte
+	if st.Code() == codes.OK {
+		if out, err = protojson.Marshal(reply); err != nil {
+			return nil, err
+		}
+	}
+	code := HTTPStatus(st.Code())
+	// Metadata keys are lower case, the header looks them up canonicalized
+	h := make(http.Header, len(header))
+	for k, values := range header {
+		for _, v := range values {
+			h.Add(k, v)
+		}
+	}
+	metrics.Response = &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     h,
+		Body:       io.NopCloser(bytes.NewReader(out)),
+	}
+	return metrics, nil
+}
+
+// grpcOpening is the opening of a grpc target, calls that come in while it
+// runs wait for it and share its outcome
+type grpcOpening struct {
+	done chan struct{}
+	gt   *grpcTarget
+	err  error
+}
+
+// grpcTarget returns the connection of target, it is opened and its method
+// resolved on the first call. Calls to other targets do not wait for it. A
+// failure is returned to the calls that waited for it and retried by the next.
+func (p *pool) grpcTarget(target *config.Target) (*grpcTarget, error) {
+	p.grpcMu.Lock()
+	opening, ok := p.grpcTargets[target]
+	if !ok {
+		opening = &grpcOpening{done: make(chan struct{})}
+		p.grpcTargets[target] = opening
+	}
+	p.grpcMu.Unlock()
+	if ok {
+		<-opening.done
+		return opening.gt, opening.err
+	}
+
+	opening.gt, opening.err = p.openGRPC(target)
+	if opening.err != nil {
+		p.grpcMu.Lock()
+		delete(p.grpcTargets, target)
+		p.grpcMu.Unlock()
+	}
+	close(opening.done)
+	return opening.gt, opening.err
+}
+
+// openGRPC connects to target and resolves its method
+func (p *pool) openGRPC(target *config.Target) (*grpcTarget, error) {
+	if target.GRPC == nil {
+		return nil, fmt.Errorf("target %s has no grpc method", target.URL)
+	}
+
+	u, err := url.Parse(target.URL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	gt := &grpcTarget{}
+	var creds credentials.TransportCredentials = insecure.NewCredentials()
+	if u.Scheme == "https" {
+		creds = &timedCredentials{TransportCredentials: credentials.NewTLS(&tls.Config{}), target: gt}
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(gt.dial),
+		grpc.WithStatsHandler(callStats{}),
+	}
+	// In dev mode the target is reached on localhost with its own name as authority
+	if target.HostHeader != "" {
+		authority := target.HostHeader
+		if h, err := url.Parse(target.HostHeader); err == nil && h.Host != "" {
+			authority = h.Host
+		}
+		opts = append(opts, grpc.WithAuthority(authority))
+	}
+	conn, err := grpc.NewClient("passthrough:///"+addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	gt.conn = conn
+
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	if gt.method, err = resolveMethod(ctx, conn, target.GRPC); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	gt.name = fmt.Sprintf("/%s/%s", gt.method.Parent().FullName(), gt.method.Name())
+	return gt, nil
+}
+
+// dial opens a TCP connection and keeps its DNS and connect time for the next call
+func (gt *grpcTarget) dial(ctx context.Context, addr string) (net.Conn, error) {
+	var setup connSetup
+	var dnsStart, connectStart time.Time
+	// Happy eyeballs runs the connect hooks of several addresses at once, and the loser's after the dial returned
+	var mu sync.Mutex
+	locked := func(f func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		f()
+	}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { locked(func() { dnsStart = time.Now() }) },
+		DNSDone:      func(httptrace.DNSDoneInfo) { locked(func() { setup.dns = time.Since(dnsStart) }) },
+		ConnectStart: func(string, string) { locked(func() { connectStart = time.Now() }) },
+		ConnectDone:  func(string, string, error) { locked(func() { setup.connect = time.Since(connectStart) }) },
+	})
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	mu.Lock()
+	dialed := setup
+	mu.Unlock()
+	gt.mu.Lock()
+	gt.setup = dialed
+	gt.mu.Unlock()
+	return conn, err
+}
+
+func (gt *grpcTarget) claimSetup() connSetup {
+	gt.mu.Lock()
+	defer gt.mu.Unlock()
+	setup := gt.setup
+	gt.setup = connSetup{}
+	return setup
+}
+
+// timedCredentials keeps the TLS handshake time for the next call
+type timedCredentials struct {
+	credentials.TransportCredentials
+	target *grpcTarget
+}
+
+func (c *timedCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	start := time.Now()
+	conn, info, err := c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	c.target.mu.Lock()
+	c.target.setup.tls = time.Since(start)
+	c.target.mu.Unlock()
+	return conn, info, err
+}
+
+func (c *timedCredentials) Clone() credentials.TransportCredentials {
+	return &timedCredentials{TransportCredentials: c.TransportCredentials.Clone(), target: c.target}
+}
+
+type callTimingKey struct{}
+
+// callTiming records when the first bytes of the answer to a call arrived
+type callTiming struct {
+	mu        sync.Mutex
+	began     time.Time
+	firstByte time.Duration
+}
+
+func (t *callTiming) start(began time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.began = began
+}
+
+func (t *callTiming) answered() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.firstByte == 0 {
+		t.firstByte = time.Since(t.began)
+	}
+}
+
+func (t *callTiming) ttfb() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.firstByte
+}
+
+// callStats marks the calls as answered on their response headers, or on
+// the trailers of an answer without a message
+type callStats struct{}
+
+func (callStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context { return ctx }
+
+func (callStats) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	timing, ok := ctx.Value(callTimingKey{}).(*callTiming)
+	if !ok {
+		return
+	}
+	switch s.(type) {
+	case *stats.InHeader, *stats.InTrailer:
+		timing.answered()
+	}
+}
+
+func (callStats) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context { return ctx }
+
+func (callStats) HandleConn(context.Context, stats.ConnStats) {}
+
+// reservedMetadata are headers grpc sets itself
+var reservedMetadata = map[string]bool{"content-type": true, "te": true, "user-agent": true, "host": true}
+
+func outgoingMetadata(headers map[string]string) metadata.MD {
+	md := metadata.MD{}
+	for k, v := range headers {
+		k = strings.ToLower(k)
+		if reservedMetadata[k] || strings.HasPrefix(k, "grpc-") {
+			continue
+		}
+		md.Append(k, v)
+	}
+	return md
+}
+
+// HTTPStatus maps a grpc status code to the HTTP status with the same meaning,
+// as the grpc-gateway does
+func HTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// resolveMethod finds the descriptor of the method in the descriptor set of
+// g, or with server reflection if it has none
+func resolveMethod(ctx context.Context, conn *grpc.ClientConn, g *config.GRPC) (protoreflect.MethodDescriptor, error) {
+	service, name, _ := strings.Cut(strings.TrimPrefix(g.Method, "/"), "/")
+	var files *protoregistry.Files
+	var err error
+	if g.DescriptorSet != "" {
+		files, err = readDescriptorSet(g.DescriptorSet)
+	} else {
+		files, err = reflectFiles(ctx, conn, service)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %w", service, err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", service)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(name))
+	if md == nil {
+		return nil, fmt.Errorf("service %s has no method %s", service, name)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("%s is a streaming method, only unary methods are supported", g.Method)
+	}
+	return md, nil
+}
+
+func readDescriptorSet(path string) (*protoregistry.Files, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("descriptor set %s: %w", path, err)
+	}
+	return protodesc.NewFiles(&set)
+}
+
+// reflectFiles asks the server for the file that defines symbol and the files
+// it imports, except for those compiled into the generator
+func reflectFiles(ctx context.Context, conn *grpc.ClientConn, symbol string) (*protoregistry.Files, error) {
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("server reflection: %w", err)
+	}
+	defer stream.CloseSend()
+
+	files := make(map[string]*descriptorpb.FileDescriptorProto)
+	asked := make(map[string]bool)
+	request := &reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+	}
+	for request != nil {
+		if err := stream.Send(request); err != nil {
+			return nil, fmt.Errorf("server reflection: %w", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, fmt.Errorf("server reflection: %w", err)
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return nil, fmt.Errorf("server reflection: %s", e.GetErrorMessage())
+		}
+		for _, raw := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			var fd descriptorpb.FileDescriptorProto
+			if err := proto.Unmarshal(raw, &fd); err != nil {
+				return nil, fmt.Errorf("server reflection: %w", err)
+			}
+			files[fd.GetName()] = &fd
+		}
+
+		// Servers may leave out imports, they are asked for one by one
+		request = nil
+		for _, fd := range files {
+			for _, dep := range fd.GetDependency() {
+				if _, ok := files[dep]; ok {
+					continue
+				}
+				if f, err := protoregistry.GlobalFiles.FindFileByPath(dep); err == nil {
+					files[dep] = protodesc.ToFileDescriptorProto(f)
+					continue
+				}
+				if asked[dep] {
+					return nil, fmt.Errorf("server reflection: %s imports %s, which the server does not have", fd.GetName(), dep)
+				}
+				asked[dep] = true
+				request = &reflectionpb.ServerReflectionRequest{
+					MessageRequest: &reflectionpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep},
+				}
+				break
+			}
+			if request != nil {
+				break
+			}
+		}
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range files {
+		set.File = append(set.File, fd)
+	}
+	return protodesc.NewFiles(set)
+}
@@ -0,0 +1,220 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const healthCheck = "grpc.health.v1.Health/Check"
+
+// healthServer answers by the service it is asked about: slow sends its
+// headers and never answers, missing is not found, the rest are serving.
+// The x-run metadata of the call comes back as a header.
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+}
+
+func (healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs("x-run", strings.Join(md.Get("x-run"), ",")))
+	switch req.GetService() {
+	case "slow":
+		grpc.SendHeader(ctx, metadata.MD{})
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case "missing":
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+// startGRPC serves the health service with reflection on a local port and returns its URL
+func startGRPC(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer{})
+	reflection.Register(server)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return "http://" + lis.Addr().String()
+}
+
+// writeHealthDescriptorSet writes the descriptor set of the health service, as protoc would
+func writeHealthDescriptorSet(t *testing.T) string {
+	t.Helper()
+	set := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(healthpb.File_grpc_health_v1_health_proto)},
+	}
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "health.pb")
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestInvoke(t *testing.T) {
+	url := startGRPC(t)
+	tests := []struct {
+		name string
+		grpc *config.GRPC
+	}{
+		{name: "descriptor set", grpc: &config.GRPC{Method: healthCheck, DescriptorSet: writeHealthDescriptorSet(t)}},
+		{name: "reflection", grpc: &config.GRPC{Method: "/" + healthCheck}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPool("", 10, 10, time.Minute, 5*time.Second, "")
+			target := &config.Target{
+				URL:     url,
+				Body:    `{"service": "benchmark"}`,
+				Headers: map[string]string{"X-Run": "42"},
+				GRPC:    tt.grpc,
+			}
+
+			metrics, err := p.Invoke(target)
+			if err != nil {
+				t.Fatalf("Invoke: %v", err)
+			}
+			if metrics.Response.StatusCode != http.StatusOK || metrics.GRPCStatus.Code() != codes.OK {
+				t.Errorf("status is %d %s, expected 200 OK", metrics.Response.StatusCode, metrics.GRPCStatus.Code())
+			}
+			if got := metrics.Response.Header.Get("x-run"); got != "42" {
+				t.Errorf("metadata x-run came back as %q", got)
+			}
+			body, err := io.ReadAll(metrics.Response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reply map[string]string
+			if err := json.Unmarshal(body, &reply); err != nil || reply["status"] != "SERVING" {
+				t.Errorf("reply is %s", body)
+			}
+			if metrics.TTFB <= 0 || metrics.Total < metrics.TTFB {
+				t.Errorf("TTFB %s and Total %s are not ordered", metrics.TTFB, metrics.Total)
+			}
+			// The first call opened the connection
+			if metrics.ConnectTime <= 0 {
+				t.Errorf("ConnectTime is %s", metrics.ConnectTime)
+			}
+
+			metrics, err = p.Invoke(target)
+			if err != nil {
+				t.Fatalf("second Invoke: %v", err)
+			}
+			if metrics.ConnectTime != 0 {
+				t.Errorf("ConnectTime of a call on an open connection is %s", metrics.ConnectTime)
+			}
+		})
+	}
+}
+
+func TestInvokeStatus(t *testing.T) {
+	p := NewPool("", 10, 10, time.Minute, 5*time.Second, "")
+	target := &config.Target{URL: startGRPC(t), Body: `{"service": "missing"}`, GRPC: &config.GRPC{Method: healthCheck}}
+
+	metrics, err := p.Invoke(target)
+	if err != nil {
+		t.Fatalf("a call that was answered is no error: %v", err)
+	}
+	if metrics.Response.StatusCode != http.StatusNotFound || metrics.GRPCStatus.Code() != codes.NotFound {
+		t.Errorf("status is %d %s, expected 404 NotFound", metrics.Response.StatusCode, metrics.GRPCStatus.Code())
+	}
+}
+
+func TestInvokeDeadline(t *testing.T) {
+	p := NewPool("", 10, 10, time.Minute, 200*time.Millisecond, "")
+	target := &config.Target{URL: startGRPC(t), Body: `{"service": "slow"}`, GRPC: &config.GRPC{Method: healthCheck}}
+
+	metrics, err := p.Invoke(target)
+	if err == nil {
+		t.Fatalf("a call past its deadline is an error, got status %d", metrics.Response.StatusCode)
+	}
+	if kind := KindOf(err); kind != KindRequestTimeout {
+		t.Errorf("kind is %s, expected %s", kind, KindRequestTimeout)
+	}
+	if metrics.Response != nil {
+		t.Errorf("a timed out call has a response with status %d", metrics.Response.StatusCode)
+	}
+	if metrics.GRPCStatus.Code() != codes.DeadlineExceeded {
+		t.Errorf("grpc status is %s", metrics.GRPCStatus.Code())
+	}
+	// The headers came back before the deadline
+	if metrics.TTFB <= 0 {
+		t.Errorf("TTFB is %s", metrics.TTFB)
+	}
+}
+
+func TestInvokeWaitsOnlyForItsOwnTarget(t *testing.T) {
+	// A server that accepts connections and never answers, so reflection runs into the timeout
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	timeout := time.Second
+	p := NewPool("", 10, 10, time.Minute, timeout, "")
+	silent := &config.Target{URL: "http://" + lis.Addr().String(), GRPC: &config.GRPC{Method: healthCheck}}
+	healthy := &config.Target{URL: startGRPC(t), Body: `{"service": "benchmark"}`, GRPC: &config.GRPC{Method: healthCheck, DescriptorSet: writeHealthDescriptorSet(t)}}
+
+	failed := make(chan time.Duration, 2)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		go func() {
+			if _, err := p.Invoke(silent); err == nil {
+				t.Error("a target whose method cannot be resolved is an error")
+			}
+			failed <- time.Since(start)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := p.Invoke(healthy); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= timeout {
+		t.Errorf("a call to a healthy target took %s while another target was being resolved", d)
+	}
+	// The second call to the silent target shares the resolution of the first
+	for i := 0; i < 2; i++ {
+		if d := <-failed; d >= 2*timeout {
+			t.Errorf("call to the silent target failed after %s, the resolution ran twice", d)
+		}
+	}
+}
@@ -1,47 +1,112 @@
 package connection
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptrace"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
 	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/status"
 )
 
 type Pool interface {
 	Get(target *config.Target) (*ResponseMetrics, error)
 	Post(target *config.Target, body io.Reader) (*ResponseMetrics, error)
+	// Send makes the request target describes, with its method, body and content type
+	Send(target *config.Target) (*ResponseMetrics, error)
 	GenerateCloudEvent(target *config.Target, event *cloudevents.Event) (*ResponseMetrics, error)
+	// Invoke calls a grpc target
+	Invoke(target *config.Target) (*ResponseMetrics, error)
 	Targets() map[*config.Target]int
 }
 
 type pool struct {
-	client  *http.Client
-	baseURL string
-	targets map[*config.Target]int
+	// clients has one client per protocol, protocol is the one of targets that do not set theirs
+	clients  map[string]*http.Client
+	protocol string
+	baseURL  string
+	timeout  time.Duration
+	targets  map[*config.Target]int
+	mu       sync.Mutex
+
+	grpcTargets map[*config.Target]*grpcOpening
+	grpcMu      sync.Mutex
 }
 
-func NewPool(baseURL string, maxIdleConns int, maxIdleConnsPerHost int, idleConnTimeout time.Duration, timeout time.Duration) Pool {
+// NewPool sends requests with protocol, or the protocol of the target if it has one
+func NewPool(baseURL string, maxIdleConns int, maxIdleConnsPerHost int, idleConnTimeout time.Duration, timeout time.Duration, protocol string) Pool {
+	if protocol == "" {
+		protocol = config.ProtocolHTTP1
+	}
+	clients := make(map[string]*http.Client)
+	for _, proto := range []string{config.ProtocolHTTP1, config.ProtocolH2, config.ProtocolH2C, config.ProtocolH3} {
+		clients[proto] = &http.Client{
+			Transport: newTransport(proto, maxIdleConns, maxIdleConnsPerHost, idleConnTimeout),
+			Timeout:   timeout,
+		}
+	}
 	return &pool{
-		baseURL: baseURL,
-		client: &http.Client{
-			Transport: &http.Transport{
-				MaxIdleConns:        maxIdleConns,
-				MaxIdleConnsPerHost: maxIdleConnsPerHost,
-				IdleConnTimeout:     idleConnTimeout,
+		clients:     clients,
+		protocol:    protocol,
+		baseURL:     baseURL,
+		timeout:     timeout,
+		targets:     make(map[*config.Target]int),
+		grpcTargets: make(map[*config.Target]*grpcOpening),
+	}
+}
+
+func newTransport(protocol string, maxIdleConns int, maxIdleConnsPerHost int, idleConnTimeout time.Duration) http.RoundTripper {
+	switch protocol {
+	case config.ProtocolH2C:
+		return &http2.Transport{
+			AllowHTTP:       true,
+			IdleConnTimeout: idleConnTimeout,
+			// Prior knowledge h2c, the "TLS" connection is plain TCP
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
 			},
-			Timeout: timeout,
-		},
+		}
+	case config.ProtocolH3:
+		return &http3.Transport{}
 	}
+
+	transport := &http.Transport{
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     idleConnTimeout,
+	}
+	if protocol == config.ProtocolH2 {
+		transport.ForceAttemptHTTP2 = true
+	} else {
+		// A non-nil empty map keeps TLS connections from negotiating HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
 }
 
+// clientFor returns the client for the protocol of target
+func (p *pool) clientFor(target *config.Target) *http.Client {
+	if client, ok := p.clients[target.Protocol]; ok {
+		return client
+	}
+	return p.clients[p.protocol]
+}
+
+// ResponseMetrics are the timings of a request. A failed request has no
+// Response, only the timings of the phases it completed and its Total until the failure.
 type ResponseMetrics struct {
 	Response    *http.Response
 	DNSTime     time.Duration
@@ -49,9 +114,12 @@ type ResponseMetrics struct {
 	TLSTime     time.Duration
 	TTFB        time.Duration
 	Total       time.Duration
+	// GRPCStatus is set for grpc calls
+	GRPCStatus *status.Status
 }
 
 func (p *pool) Get(target *config.Target) (*ResponseMetrics, error) {
+	p.count(target)
 	req, err := http.NewRequest("GET", target.URL, nil)
 	if err != nil {
 		return nil, err
@@ -62,15 +130,20 @@ func (p *pool) Get(target *config.Target) (*ResponseMetrics, error) {
 		req.Host = target.HostHeader
 	}
 
-	// Add any additional headers
-	for k, v := range target.Headers {
+	// Add any additional headers, with their templates executed
+	headers, _, err := target.Render()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
 
-	return p.executeWithMetrics(req)
+	return p.executeWithMetrics(p.clientFor(target), req)
 }
 
 func (p *pool) Post(target *config.Target, body io.Reader) (*ResponseMetrics, error) {
+	p.count(target)
 	req, err := http.NewRequest("POST", target.URL, body)
 	if err != nil {
 		return nil, err
@@ -81,29 +154,78 @@ func (p *pool) Post(target *config.Target, body io.Reader) (*ResponseMetrics, er
 		req.Host = target.HostHeader
 	}
 
-	// Add any additional headers
-	for k, v := range target.Headers {
+	// Add any additional headers, with their templates executed
+	headers, _, err := target.Render()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
 
 	// Set content type if not specified
-	if _, exists := target.Headers["Content-Type"]; !exists {
+	if _, exists := headers["Content-Type"]; !exists {
 		req.Header.Set("Content-Type", "application/json")
 	}
 
-	return p.executeWithMetrics(req)
+	return p.executeWithMetrics(p.clientFor(target), req)
+}
+
+func (p *pool) Send(target *config.Target) (*ResponseMetrics, error) {
+	p.count(target)
+	headers, body, err := target.Render()
+	if err != nil {
+		return nil, err
+	}
+	var reader io.Reader
+	if payload := target.Payload(); payload != nil {
+		reader = bytes.NewReader(payload)
+	} else if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(target.HTTPMethod(), target.URL, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set Host header if specified
+	if target.HostHeader != "" {
+		req.Host = target.HostHeader
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if reader != nil && (target.ContentType != "" || req.Header.Get("Content-Type") == "") {
+		req.Header.Set("Content-Type", target.ContentTypeOf())
+	}
+
+	return p.executeWithMetrics(p.clientFor(target), req)
 }
 
 func (p *pool) GenerateCloudEvent(target *config.Target, event *cloudevents.Event) (*ResponseMetrics, error) {
+	p.count(target)
 	req, err := cehttp.NewHTTPRequestFromEvent(context.Background(), target.URL, *event)
 	if err != nil {
 		return nil, err
 	}
-	return p.executeWithMetrics(req)
+	return p.executeWithMetrics(p.clientFor(target), req)
 }
 
+// Targets returns how many requests were sent to each target so far
 func (p *pool) Targets() map[*config.Target]int {
-	return p.targets
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	counts := make(map[*config.Target]int, len(p.targets))
+	for target, n := range p.targets {
+		counts[target] = n
+	}
+	return counts
+}
+
+func (p *pool) count(target *config.Target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.targets[target]++
 }
 
 type poolMock struct {
@@ -154,6 +276,14 @@ func (p *poolMock) Post(target *config.Target, body io.Reader) (*ResponseMetrics
 	}, nil
 }
 
+func (p *poolMock) Send(target *config.Target) (*ResponseMetrics, error) {
+	return p.Get(target)
+}
+
+func (p *poolMock) Invoke(target *config.Target) (*ResponseMetrics, error) {
+	return p.Get(target)
+}
+
 func (p *poolMock) Targets() map[*config.Target]int {
 	return p.targets
 }
@@ -170,47 +300,77 @@ func NewPoolMock(c *config.Config) Pool {
 	}
 }
 
-func (p *pool) executeWithMetrics(req *http.Request) (*ResponseMetrics, error) {
+func (p *pool) executeWithMetrics(client *http.Client, req *http.Request) (*ResponseMetrics, error) {
 	var metrics ResponseMetrics
 	var start = time.Now()
 	var dnsStart, connectStart, tlsStart time.Time
+	// step is where the request is, for the kind of a timeout
+	var step atomic.Int32
+	// mu guards metrics and the start times. The hooks of a dial that outlives a
+	// failed request can still run, and happy eyeballs dials several addresses at once.
+	var mu sync.Mutex
+	begin := func(field *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*field = time.Now()
+	}
+	record := func(field *time.Duration, since *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*field = time.Since(*since)
+	}
 
 	trace := &httptrace.ClientTrace{
 		DNSStart: func(dsi httptrace.DNSStartInfo) {
-			dnsStart = time.Now()
+			step.Store(stepDNS)
+			begin(&dnsStart)
 		},
 		DNSDone: func(ddi httptrace.DNSDoneInfo) {
-			metrics.DNSTime = time.Since(dnsStart)
+			record(&metrics.DNSTime, &dnsStart)
 		},
 
 		ConnectStart: func(network, addr string) {
-			connectStart = time.Now()
+			step.Store(stepConnect)
+			begin(&connectStart)
 		},
 		ConnectDone: func(network, addr string, err error) {
-			metrics.ConnectTime = time.Since(connectStart)
+			record(&metrics.ConnectTime, &connectStart)
 		},
 
 		TLSHandshakeStart: func() {
-			tlsStart = time.Now()
+			step.Store(stepTLS)
+			begin(&tlsStart)
 		},
 		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
-			metrics.TLSTime = time.Since(tlsStart)
+			record(&metrics.TLSTime, &tlsStart)
+		},
+
+		GotConn: func(httptrace.GotConnInfo) {
+			step.Store(stepNone)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			step.Store(stepWrote)
 		},
 
 		GotFirstResponseByte: func() {
-			metrics.TTFB = time.Since(start)
+			step.Store(stepResponse)
+			record(&metrics.TTFB, &start)
 		},
 	}
 
 	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
 
-	resp, err := p.client.Do(req)
+	resp, err := client.Do(req)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The caller gets a copy that later hooks do not change
+	result := metrics
+	result.Total = time.Since(start)
 	if err != nil {
-		return nil, err
+		// The phases that completed are kept, Total is the time until the failure
+		return &result, &Error{Kind: classify(err, step.Load()), Err: err}
 	}
-
-	metrics.Response = resp
-	metrics.Total = time.Since(start)
-
-	return &metrics, nil
+	result.Response = resp
+	return &result, nil
 }
@@ -0,0 +1,122 @@
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// protoHandler answers with the protocol the request came in with
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.Proto)
+})
+
+// trust makes the clients of p accept the certificate of the test servers
+func trust(p Pool, cert *x509.Certificate) {
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	for _, client := range p.(*pool).clients {
+		switch t := client.Transport.(type) {
+		case *http.Transport:
+			t.TLSClientConfig = &tls.Config{RootCAs: roots}
+		case *http3.Transport:
+			t.TLSClientConfig = &tls.Config{RootCAs: roots}
+		}
+	}
+}
+
+// startH3 serves handler over HTTP/3 on a local UDP port with the certificate of tlsServer
+func startH3(t *testing.T, tlsServer *httptest.Server, handler http.Handler) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: tlsServer.TLS.Certificates}),
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		server.Close()
+		conn.Close()
+	})
+	return "https://" + conn.LocalAddr().String()
+}
+
+func TestSendProtocols(t *testing.T) {
+	plain := httptest.NewServer(protoHandler)
+	defer plain.Close()
+	h2cServer := httptest.NewServer(h2c.NewHandler(protoHandler, &http2.Server{}))
+	defer h2cServer.Close()
+	tlsServer := httptest.NewUnstartedServer(protoHandler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	h3URL := startH3(t, tlsServer, protoHandler)
+
+	tests := []struct {
+		name string
+		// pool is the protocol of the pool, target the one of the target
+		pool, target string
+		url          string
+		want         string
+		tls          bool
+	}{
+		{name: "http1 default", url: plain.URL, want: "HTTP/1.1"},
+		{name: "http1 over TLS does not negotiate h2", target: config.ProtocolHTTP1, url: tlsServer.URL, want: "HTTP/1.1", tls: true},
+		{name: "h2", target: config.ProtocolH2, url: tlsServer.URL, want: "HTTP/2.0", tls: true},
+		{name: "h2 from the pool", pool: config.ProtocolH2, url: tlsServer.URL, want: "HTTP/2.0", tls: true},
+		{name: "h2c", target: config.ProtocolH2C, url: h2cServer.URL, want: "HTTP/2.0"},
+		{name: "h3", target: config.ProtocolH3, url: h3URL, want: "HTTP/3.0", tls: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPool("", 10, 10, time.Minute, 5*time.Second, tt.pool)
+			trust(p, tlsServer.Certificate())
+			target := &config.Target{URL: tt.url, Protocol: tt.target}
+
+			metrics, err := p.Send(target)
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			defer metrics.Response.Body.Close()
+			body, err := io.ReadAll(metrics.Response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if metrics.Response.Proto != tt.want {
+				t.Errorf("response protocol is %s, expected %s", metrics.Response.Proto, tt.want)
+			}
+			if string(body) != tt.want {
+				t.Errorf("server saw %s, expected %s", body, tt.want)
+			}
+			if metrics.TTFB <= 0 || metrics.Total < metrics.TTFB {
+				t.Errorf("TTFB %s and Total %s are not ordered", metrics.TTFB, metrics.Total)
+			}
+			if metrics.ConnectTime <= 0 {
+				t.Errorf("ConnectTime is %s", metrics.ConnectTime)
+			}
+			if tt.tls && metrics.TLSTime <= 0 {
+				t.Errorf("TLSTime is %s", metrics.TLSTime)
+			}
+			if !tt.tls && metrics.TLSTime != 0 {
+				t.Errorf("TLSTime is %s without TLS", metrics.TLSTime)
+			}
+			if got := p.Targets()[target]; got != 1 {
+				t.Errorf("target was counted %d times", got)
+			}
+		})
+	}
+}
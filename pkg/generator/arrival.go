@@ -0,0 +1,199 @@
+package generator
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+// arrivalProcess produces the gap until the next request for a given mean rate.
+// The rate is passed on every call so the same process can be used while ramping.
+type arrivalProcess interface {
+	next(rate float64) time.Duration
+}
+
+func newArrivalProcess(a config.Arrival) (arrivalProcess, error) {
+	seed := a.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	switch a.Process {
+	case "", config.ArrivalConstant:
+		return constantArrival{}, nil
+	case config.ArrivalPoisson:
+		return &poissonArrival{rng: rng}, nil
+	case config.ArrivalUniform:
+		if a.Jitter < 0 || a.Jitter > 1 {
+			return nil, fmt.Errorf("uniform jitter must be between 0 and 1, got %v", a.Jitter)
+		}
+		return &uniformArrival{rng: rng, jitter: a.Jitter}, nil
+	case config.ArrivalGamma:
+		if a.CV <= 0 {
+			return nil, fmt.Errorf("gamma cv must be positive, got %v", a.CV)
+		}
+		return &gammaArrival{rng: rng, shape: 1 / (a.CV * a.CV)}, nil
+	default:
+		return nil, fmt.Errorf("unknown arrival process %q", a.Process)
+	}
+}
+
+func meanInterval(rate float64) float64 {
+	return float64(time.Second) / rate
+}
+
+type constantArrival struct{}
+
+func (constantArrival) next(rate float64) time.Duration {
+	return time.Duration(meanInterval(rate))
+}
+
+// poissonArrival draws exponentially distributed gaps
+type poissonArrival struct {
+	rng *rand.Rand
+}
+
+func (p *poissonArrival) next(rate float64) time.Duration {
+	return time.Duration(p.rng.ExpFloat64() * meanInterval(rate))
+}
+
+// uniformArrival spreads gaps uniformly in [mean*(1-jitter), mean*(1+jitter)]
+type uniformArrival struct {
+	rng    *rand.Rand
+	jitter float64
+}
+
+func (u *uniformArrival) next(rate float64) time.Duration {
+	factor := 1 + u.jitter*(2*u.rng.Float64()-1)
+	return time.Duration(factor * meanInterval(rate))
+}
+
+// gammaArrival draws gamma distributed gaps with shape 1/cv^2, so cv > 1 gives
+// burstier traffic than poisson and cv < 1 more regular traffic.
+type gammaArrival struct {
+	rng   *rand.Rand
+	shape float64
+}
+
+func (g *gammaArrival) next(rate float64) time.Duration {
+	// Scale so that the mean stays 1/rate
+	return time.Duration(sampleGamma(g.rng, g.shape) / g.shape * meanInterval(rate))
+}
+
+// sampleGamma returns a Gamma(shape, 1) sample using Marsaglia and Tsang's method.
+func sampleGamma(rng *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		// Boost the shape and correct with U^(1/shape)
+		return sampleGamma(rng, shape+1) * math.Pow(rng.Float64(), 1/shape)
+	}
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// rateCheck is how often schedule looks at the rate again, while it is 0 and
+// while a gap drawn at one rate runs on into another
+const rateCheck = 10 * time.Millisecond
+
+// schedule runs an open-loop arrival process and calls fire once per arrival
+// with the time the request was supposed to be sent. rateAt returns the mean
+// rate for the elapsed time since the schedule started. Arrivals are never
+// dropped when the loop falls behind, the delay shows up as the difference
+// between the intended and the actual send time instead.
+// It returns the number of arrivals once ctx is done or duration has passed.
+func schedule(ctx context.Context, arrivals arrivalProcess, rateAt func(elapsed time.Duration) float64, duration time.Duration, fire func(intended time.Time)) int {
+	start := time.Now()
+	intended := start
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	count := 0
+	for {
+		if ctx.Err() != nil {
+			return count
+		}
+		elapsed := intended.Sub(start)
+		if duration > 0 && elapsed >= duration {
+			return count
+		}
+
+		rate := rateAt(elapsed)
+		if rate <= 0 {
+			// Nothing to send right now, check again shortly
+			intended = intended.Add(rateCheck)
+			timer.Reset(time.Until(intended))
+			select {
+			case <-ctx.Done():
+				return count
+			case <-timer.C:
+			}
+			continue
+		}
+
+		next, due := advance(arrivals, rateAt, elapsed, rate, duration)
+		if duration > 0 && next >= duration {
+			return count
+		}
+		intended = start.Add(next)
+		timer.Reset(time.Until(intended))
+		select {
+		case <-ctx.Done():
+			return count
+		case <-timer.C:
+		}
+		if !due {
+			continue
+		}
+		fire(intended)
+		count++
+	}
+}
+
+// advance returns the elapsed time of the next arrival after elapsed, where the
+// rate is rate. The gap is drawn at rate and what is left of it is rescaled to
+// the rate of every rateCheck it spans, so a ramp from 0 does not wait out a gap
+// drawn at its first, tiny rate. due is false if the rate dropped to 0 first,
+// the time returned is then when it did.
+func advance(arrivals arrivalProcess, rateAt func(elapsed time.Duration) float64, elapsed time.Duration, rate float64, duration time.Duration) (next time.Duration, due bool) {
+	gap := arrivals.next(rate)
+	for gap > rateCheck {
+		elapsed += rateCheck
+		gap -= rateCheck
+		if duration > 0 && elapsed >= duration {
+			return elapsed, true
+		}
+		current := rateAt(elapsed)
+		if current <= 0 {
+			return elapsed, false
+		}
+		if current != rate {
+			gap = time.Duration(float64(gap) * rate / current)
+			rate = current
+		}
+	}
+	return elapsed + gap, true
+}
+
+// constantRate is a rateAt function for schedule that never changes
+func constantRate(rate float64) func(time.Duration) float64 {
+	return func(time.Duration) float64 {
+		return rate
+	}
+}
@@ -0,0 +1,144 @@
+package generator
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+func TestArrivalProcessMeans(t *testing.T) {
+	const rate, n = 100.0, 100000
+	mean := time.Second / rate
+	tests := []struct {
+		name    string
+		arrival config.Arrival
+		// wantCV is the coefficient of variation of the gaps
+		wantCV float64
+		// min and max bound every gap, as a multiple of the mean
+		min, max float64
+	}{
+		{name: "constant", arrival: config.Arrival{Process: config.ArrivalConstant}, wantCV: 0, min: 1, max: 1},
+		{name: "poisson", arrival: config.Arrival{Process: config.ArrivalPoisson, Seed: 1}, wantCV: 1, min: 0, max: math.Inf(1)},
+		{name: "uniform", arrival: config.Arrival{Process: config.ArrivalUniform, Seed: 1, Jitter: 0.5}, wantCV: 0.5 / math.Sqrt(3), min: 0.5, max: 1.5},
+		{name: "bursty gamma", arrival: config.Arrival{Process: config.ArrivalGamma, Seed: 1, CV: 2}, wantCV: 2, min: 0, max: math.Inf(1)},
+		{name: "regular gamma", arrival: config.Arrival{Process: config.ArrivalGamma, Seed: 1, CV: 0.5}, wantCV: 0.5, min: 0, max: math.Inf(1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arrivals, err := newArrivalProcess(tt.arrival)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sum, sumSquares float64
+			for i := 0; i < n; i++ {
+				gap := arrivals.next(rate)
+				if ratio := float64(gap) / float64(mean); ratio < tt.min-1e-9 || ratio > tt.max+1e-9 {
+					t.Fatalf("gap %s is outside [%v, %v] times the mean", gap, tt.min, tt.max)
+				}
+				sum += float64(gap)
+				sumSquares += float64(gap) * float64(gap)
+			}
+			gotMean := sum / n
+			gotCV := math.Sqrt(sumSquares/n-gotMean*gotMean) / gotMean
+			if math.Abs(gotMean/float64(mean)-1) > 0.02 {
+				t.Errorf("mean gap is %s, expected %s", time.Duration(gotMean), mean)
+			}
+			if math.Abs(gotCV-tt.wantCV) > 0.05*math.Max(tt.wantCV, 0.1) {
+				t.Errorf("cv of the gaps is %.3f, expected %.3f", gotCV, tt.wantCV)
+			}
+		})
+	}
+}
+
+func TestArrivalProcessSeed(t *testing.T) {
+	for _, process := range []string{config.ArrivalPoisson, config.ArrivalUniform, config.ArrivalGamma} {
+		t.Run(process, func(t *testing.T) {
+			arrival := config.Arrival{Process: process, Seed: 42, Jitter: 0.3, CV: 1.5}
+			a, err := newArrivalProcess(arrival)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := newArrivalProcess(arrival)
+			for i := 0; i < 100; i++ {
+				if x, y := a.next(50), b.next(50); x != y {
+					t.Fatalf("gap %d is %s and %s with the same seed", i, x, y)
+				}
+			}
+		})
+	}
+}
+
+func TestNewArrivalProcessRejects(t *testing.T) {
+	for _, a := range []config.Arrival{
+		{Process: config.ArrivalUniform, Jitter: -0.1},
+		{Process: config.ArrivalUniform, Jitter: 1.5},
+		{Process: config.ArrivalGamma},
+		{Process: "bursty"},
+	} {
+		if _, err := newArrivalProcess(a); err == nil {
+			t.Errorf("%+v was accepted", a)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	var intended []time.Time
+	before := time.Now()
+	count := schedule(context.Background(), constantArrival{}, constantRate(200), 100*time.Millisecond, func(at time.Time) {
+		intended = append(intended, at)
+	})
+
+	// Arrivals every 5ms, the one at 100ms is past the duration
+	if count != 19 || len(intended) != 19 {
+		t.Fatalf("counted %d of %d arrivals, expected 19", count, len(intended))
+	}
+	if first := intended[0].Sub(before); first < 5*time.Millisecond || first > 20*time.Millisecond {
+		t.Errorf("first arrival %s after the start", first)
+	}
+	for i := 1; i < len(intended); i++ {
+		if gap := intended[i].Sub(intended[i-1]); gap != 5*time.Millisecond {
+			t.Errorf("gap %d is %s, intended times follow the process and not the loop", i, gap)
+		}
+	}
+}
+
+func TestScheduleWaitsWhileRateIsZero(t *testing.T) {
+	rateAt := func(elapsed time.Duration) float64 {
+		if elapsed < 50*time.Millisecond {
+			return 0
+		}
+		return 100
+	}
+	var intended []time.Time
+	before := time.Now()
+	count := schedule(context.Background(), constantArrival{}, rateAt, 100*time.Millisecond, func(at time.Time) {
+		intended = append(intended, at)
+	})
+
+	// The rate is checked every 10ms, it is 100 from 50ms on and the first gap is 10ms
+	if count != 4 {
+		t.Fatalf("counted %d arrivals, expected those at 60, 70, 80 and 90ms", count)
+	}
+	if first := intended[0].Sub(before); first < 60*time.Millisecond || first > 75*time.Millisecond {
+		t.Errorf("first arrival %s after the start", first)
+	}
+}
+
+func TestScheduleStopsOnContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// Without a duration only ctx ends a schedule, also one that never fires
+	count := schedule(ctx, constantArrival{}, constantRate(0), 0, func(time.Time) {
+		t.Error("fired at a rate of 0")
+	})
+	if count != 0 {
+		t.Errorf("counted %d arrivals", count)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Errorf("returned %s after the start", d)
+	}
+}
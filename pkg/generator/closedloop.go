@@ -0,0 +1,174 @@
+package generator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/luccadibe/knativeBenchmark/pkg/connection"
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+)
+
+var _ Generator = &closedLoopGenerator{}
+
+// closedLoopGenerator runs virtual users that only send their next request
+// once the previous one finished, so the offered load backs off when the
+// service slows down. It reuses the HTTP request path of generator.
+type closedLoopGenerator struct {
+	*generator
+	// users holds the cancel function of every running user, newest last
+	users []context.CancelFunc
+	// usersWg tracks the user goroutines, requests are sent inline by each user
+	usersWg sync.WaitGroup
+}
+
+func NewClosedLoopGenerator(ctx context.Context, cfg *config.Config, logger *slog.Logger, pool connection.Pool, results store.Sink) Generator {
+	return &closedLoopGenerator{
+		generator: New(ctx, cfg, logger, pool, results).(*generator),
+	}
+}
+
+// Start implements Generator.
+func (c *closedLoopGenerator) Start() error {
+	err := c.run()
+	c.usersWg.Wait()
+	return err
+}
+
+// Stop implements Generator.
+func (c *closedLoopGenerator) Stop() {
+	c.cancel()
+	c.usersWg.Wait()
+}
+
+// StartColdStart implements Generator.
+func (c *closedLoopGenerator) StartColdStart() error {
+	return fmt.Errorf("cold start mode is not supported in closed-loop mode")
+}
+
+// StartSearch implements Generator.
+func (c *closedLoopGenerator) StartSearch() (SearchResult, error) {
+	return SearchResult{}, fmt.Errorf("search mode is not supported in closed-loop mode")
+}
+
+func (c *closedLoopGenerator) run() error {
+	cl := c.cfg.ClosedLoop
+	switch cl.ThinkTimeDistribution {
+	case "", config.ThinkConstant, config.ThinkExponential:
+	default:
+		return fmt.Errorf("unknown think time distribution %q", cl.ThinkTimeDistribution)
+	}
+	// Validate the selection mode before starting any user
+	if _, err := newTargetSelector(c.cfg.Rate.TargetSelection, c.cfg.Targets, c.cfg.Rate.Arrival.Seed); err != nil {
+		return err
+	}
+
+	stages := cl.Stages
+	if len(stages) == 0 {
+		stages = []config.UserStage{{Name: phaseSteady, Users: cl.Users, Duration: c.cfg.Rate.Duration}}
+	}
+
+	c.logger.Info("Starting closed-loop workload generation", "stages", len(stages), "thinkTime", cl.ThinkTime.Duration)
+
+	for i, stage := range stages {
+		name := stage.Name
+		if name == "" {
+			name = fmt.Sprintf("stage-%d", i)
+		}
+		c.set(name, 0)
+		c.scaleUsers(stage.Users)
+		c.logger.Info("Starting stage", "phase", name, "users", stage.Users, "duration", stage.Duration.Duration)
+
+		if !c.wait(stage.Duration.Duration) {
+			c.logger.Info("Generator stopped")
+			return nil
+		}
+	}
+
+	c.logger.Info("All stages complete")
+	c.Stop()
+	return nil
+}
+
+// wait blocks for d, or until the generator is stopped if d is 0.
+// It returns false if the generator was stopped.
+func (c *closedLoopGenerator) wait(d time.Duration) bool {
+	if d <= 0 {
+		<-c.ctx.Done()
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-c.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// scaleUsers starts or stops users until n are running. The newest users are stopped first.
+func (c *closedLoopGenerator) scaleUsers(n int) {
+	for len(c.users) < n {
+		ctx, cancel := context.WithCancel(c.ctx)
+		id := len(c.users)
+		c.users = append(c.users, cancel)
+		c.usersWg.Add(1)
+		go func() {
+			defer c.usersWg.Done()
+			c.user(ctx, id)
+		}()
+	}
+	for len(c.users) > n {
+		last := len(c.users) - 1
+		c.users[last]()
+		c.users = c.users[:last]
+	}
+}
+
+// user is the loop of one virtual user: send, wait for the response, think, repeat
+func (c *closedLoopGenerator) user(ctx context.Context, id int) {
+	seed := c.cfg.Rate.Arrival.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	seed += int64(id)
+	// Every user has its own selector and random source so users never share state
+	selector, _ := newTargetSelector(c.cfg.Rate.TargetSelection, c.cfg.Targets, seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	for {
+		intended := time.Now()
+		for _, target := range selector.next() {
+			if ctx.Err() != nil {
+				return
+			}
+			if _, err := c.sendRequest(target, intended, c.Status().Phase); err != nil && c.ctx.Err() == nil {
+				c.logger.Error("Request failed", "error", err, "user", id)
+			}
+		}
+
+		timer.Reset(c.thinkTime(rng))
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *closedLoopGenerator) thinkTime(rng *rand.Rand) time.Duration {
+	mean := c.cfg.ClosedLoop.ThinkTime.Duration
+	if c.cfg.ClosedLoop.ThinkTimeDistribution == config.ThinkExponential {
+		return time.Duration(rng.ExpFloat64() * float64(mean))
+	}
+	return mean
+}
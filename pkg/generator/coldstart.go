@@ -0,0 +1,262 @@
+package generator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/luccadibe/knativeBenchmark/pkg/connection"
+	"github.com/luccadibe/knativeBenchmark/pkg/knative"
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+)
+
+// Cold start defaults, used when the config leaves a field empty
+const (
+	defaultColdStartGap     = 7 * time.Second
+	defaultReplicaPoll      = 2 * time.Second
+	defaultScaleToZeroLimit = 5 * time.Minute
+)
+
+// unknownReplicas is recorded as the pod count when replicas are not watched
+const unknownReplicas = -1
+
+var _ Generator = &coldStartGenerator{}
+
+// coldStartGenerator probes every target in turn and can make sure each one
+// scaled to zero first, by watching its replicas or by leaving it idle
+type coldStartGenerator struct {
+	*generator
+	// replicas is nil unless scale to zero is confirmed through the Kubernetes API
+	replicas knative.Replicas
+	// lastProbe is when each target was last probed, for the idle confirmation
+	lastProbe map[*config.Target]time.Time
+}
+
+func NewColdStartGenerator(ctx context.Context, cfg *config.Config, logger *slog.Logger, pool connection.Pool, results store.Sink, replicas knative.Replicas) Generator {
+	return &coldStartGenerator{
+		generator: New(ctx, cfg, logger, pool, results).(*generator),
+		replicas:  replicas,
+	}
+}
+
+// StartColdStart implements Generator.
+func (c *coldStartGenerator) StartColdStart() error {
+	err := c.runColdStart()
+	c.wg.Wait()
+	return err
+}
+
+func (c *coldStartGenerator) runColdStart() error {
+	cfg := c.cfg.ColdStart
+	switch cfg.Confirm {
+	case "", config.ConfirmNone:
+	case config.ConfirmIdle:
+		if cfg.IdlePeriod.Duration <= 0 {
+			return fmt.Errorf("idle confirmation needs a positive idlePeriod")
+		}
+	case config.ConfirmReplicas:
+		if c.replicas == nil {
+			return fmt.Errorf("replica confirmation needs access to the Kubernetes API")
+		}
+	default:
+		return fmt.Errorf("unknown scale to zero confirmation %q", cfg.Confirm)
+	}
+
+	arrivals, err := newArrivalProcess(c.cfg.Rate.Arrival)
+	if err != nil {
+		return err
+	}
+	c.arrivals = arrivals
+	c.lastProbe = make(map[*config.Target]time.Time)
+	gap := cfg.Gap.Duration
+	if gap <= 0 {
+		gap = defaultColdStartGap
+	}
+	c.set(phaseSteady, c.cfg.Rate.RequestsPerSecond)
+	c.logger.Info("Calculated mean interval", "interval", time.Duration(meanInterval(c.cfg.Rate.RequestsPerSecond)), "confirm", cfg.Confirm, "gap", gap)
+
+	// A round of probes can outlast the interval, the arrivals during it are
+	// stale and would start the next rounds back to back
+	var roundEnd time.Time
+	stale := 0
+	schedule(c.ctx, c.arrivals, constantRate(c.cfg.Rate.RequestsPerSecond), c.cfg.Rate.Duration.Duration, func(intended time.Time) {
+		if intended.Before(roundEnd) {
+			stale++
+			return
+		}
+		defer func() { roundEnd = time.Now() }()
+		for i, target := range c.cfg.Targets {
+			if c.ctx.Err() != nil {
+				return
+			}
+			// Without confirmation each probe is planned gap after the previous
+			// one, so slow cold starts that push later probes back show up in
+			// the corrected latencies. Waiting for scale to zero is deliberate,
+			// those probes are planned for when the wait ended.
+			planned := intended.Add(time.Duration(i) * gap)
+			if cfg.Confirm != "" && cfg.Confirm != config.ConfirmNone {
+				planned = time.Time{}
+			}
+			c.probe(target, planned)
+			sleep(c.ctx, gap)
+		}
+	})
+	if stale > 0 {
+		c.logger.Info("Skipped arrivals during rounds of probes", "skipped", stale)
+	}
+
+	if c.ctx.Err() != nil {
+		c.logger.Info("Generator stopped")
+		return nil
+	}
+	c.logger.Info("Duration reached", "duration", c.cfg.Rate.Duration.Duration)
+	c.Stop()
+	return nil
+}
+
+// probe confirms target scaled to zero, sends one request and writes its
+// result with the pods before and after. A probe that is not sent is written
+// as skipped. A zero planned time means right after the confirmation.
+func (c *coldStartGenerator) probe(target *config.Target, planned time.Time) {
+	logger := c.logger.With("target", target.URL)
+	start := time.Now()
+	podsBefore, outcome, err := c.confirm(target)
+	probe := &store.Probe{PodsBefore: podsBefore, Waited: time.Since(start)}
+	if c.ctx.Err() != nil {
+		return
+	}
+	if outcome != "" {
+		probe.Outcome, probe.PodsAfter = outcome, c.pods(target)
+		result := newResult(c.cfg, target, time.Now(), phaseSteady)
+		result.Sent, result.Outcome, result.Probe = result.Intended, store.OutcomeSkipped, probe
+		if err != nil {
+			result.Error = err.Error()
+		}
+		writeResult(c.results, c.logger, result)
+		logger.Warn("Cold start probe", "outcome", outcome, "error", err, "waited", probe.Waited, "podsBefore", podsBefore, "podsAfter", probe.PodsAfter)
+		return
+	}
+
+	if planned.IsZero() {
+		planned = time.Now()
+	}
+	result, metrics, err := c.attempt(target, planned, phaseSteady)
+	if result == nil {
+		return
+	}
+	// A failed probe can still have woken the target, the idle period starts over either way
+	c.lastProbe[target] = time.Now()
+	probe.Outcome, probe.PodsAfter = store.ProbeSent, c.pods(target)
+	if err != nil {
+		probe.Outcome = store.ProbeFailed
+	}
+	result.Probe = probe
+	writeResult(c.results, c.logger, *result)
+	if err != nil {
+		if c.ctx.Err() != nil {
+			return
+		}
+		attrs := []any{"outcome", probe.Outcome, "error", err, "waited", probe.Waited, "podsBefore", podsBefore, "podsAfter", probe.PodsAfter}
+		if metrics != nil {
+			// Where the time went before the probe failed
+			attrs = append(attrs, "elapsed", metrics.Total, "DNS", metrics.DNSTime, "Connect", metrics.ConnectTime, "TLS", metrics.TLSTime)
+		}
+		logger.Error("Cold start probe", attrs...)
+		return
+	}
+	logger.Info("Cold start probe",
+		"outcome", probe.Outcome,
+		"TTFB", metrics.TTFB,
+		"Total", metrics.Total,
+		"status", metrics.Response.StatusCode,
+		"waited", probe.Waited,
+		"podsBefore", podsBefore,
+		"podsAfter", probe.PodsAfter)
+}
+
+// confirm waits until target has no pods. It returns the pods seen last, and
+// a non-empty outcome if the probe must not be sent.
+func (c *coldStartGenerator) confirm(target *config.Target) (int, string, error) {
+	cfg := c.cfg.ColdStart
+	switch cfg.Confirm {
+	case config.ConfirmIdle:
+		if last, ok := c.lastProbe[target]; ok {
+			sleep(c.ctx, time.Until(last.Add(cfg.IdlePeriod.Duration)))
+		} else {
+			sleep(c.ctx, cfg.IdlePeriod.Duration)
+		}
+		return c.pods(target), "", nil
+	case config.ConfirmReplicas:
+		return c.waitForZero(target)
+	default:
+		return c.pods(target), "", nil
+	}
+}
+
+// waitForZero polls the ready pods of target until there are none or the timeout passes
+func (c *coldStartGenerator) waitForZero(target *config.Target) (int, string, error) {
+	cfg := c.cfg.ColdStart
+	poll := cfg.PollInterval.Duration
+	if poll <= 0 {
+		poll = defaultReplicaPoll
+	}
+	limit := cfg.Timeout.Duration
+	if limit <= 0 {
+		limit = defaultScaleToZeroLimit
+	}
+	namespace, service, err := knative.ServiceOf(target)
+	if err != nil {
+		return unknownReplicas, store.ProbeReplicaError, err
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, limit)
+	defer cancel()
+	for {
+		pods, err := c.replicas.Ready(ctx, namespace, service)
+		if err != nil {
+			if ctx.Err() != nil {
+				return unknownReplicas, store.ProbeNotConfirmed, ctx.Err()
+			}
+			return unknownReplicas, store.ProbeReplicaError, err
+		}
+		if pods == 0 {
+			return 0, "", nil
+		}
+		select {
+		case <-ctx.Done():
+			return pods, store.ProbeNotConfirmed, fmt.Errorf("%d pods left after %s", pods, limit)
+		case <-time.After(poll):
+		}
+	}
+}
+
+// pods returns the ready pods of target, or unknownReplicas if they are not
+// watched or the run is ending
+func (c *coldStartGenerator) pods(target *config.Target) int {
+	if c.replicas == nil || c.ctx.Err() != nil {
+		return unknownReplicas
+	}
+	namespace, service, err := knative.ServiceOf(target)
+	if err != nil {
+		return unknownReplicas
+	}
+	pods, err := c.replicas.Ready(c.ctx, namespace, service)
+	if err != nil {
+		c.logger.Error("Failed to read replicas", "target", target.URL, "error", err)
+		return unknownReplicas
+	}
+	return pods
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,202 @@
+package generator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/luccadibe/knativeBenchmark/pkg/connection"
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+)
+
+// fakeReplicas returns its counts in turn and then the last one, or err
+type fakeReplicas struct {
+	mu     sync.Mutex
+	counts []int
+	err    error
+	calls  int
+}
+
+func (f *fakeReplicas) Ready(ctx context.Context, namespace, service string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return 0, f.err
+	}
+	n := f.counts[min(f.calls, len(f.counts)-1)]
+	f.calls++
+	return n, nil
+}
+
+// memorySink keeps the results written to it
+type memorySink struct {
+	mu      sync.Mutex
+	results []store.Result
+}
+
+func (s *memorySink) Write(r store.Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = append(s.results, r)
+	return nil
+}
+
+func (s *memorySink) Close() error { return nil }
+
+func (s *memorySink) all() []store.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]store.Result(nil), s.results...)
+}
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func coldStartConfig(confirm string) *config.Config {
+	return &config.Config{
+		Targets: []*config.Target{{URL: "http://hello.functions.example.com", Weight: 1}},
+		ColdStart: config.ColdStart{
+			Confirm:      confirm,
+			PollInterval: config.Duration{Duration: time.Millisecond},
+			Timeout:      config.Duration{Duration: 30 * time.Millisecond},
+		},
+	}
+}
+
+func TestProbeResults(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas *fakeReplicas
+		// want is the probe, Waited is the least it waited
+		want    store.Probe
+		outcome string
+		sent    bool
+	}{
+		{
+			name:     "scaled to zero",
+			replicas: &fakeReplicas{counts: []int{2, 1, 0, 1}},
+			want:     store.Probe{Outcome: store.ProbeSent, PodsBefore: 0, PodsAfter: 1, Waited: 2 * time.Millisecond},
+			outcome:  store.OutcomeOK,
+			sent:     true,
+		},
+		{
+			name:     "not scaled to zero",
+			replicas: &fakeReplicas{counts: []int{1}},
+			want:     store.Probe{Outcome: store.ProbeNotConfirmed, PodsBefore: 1, PodsAfter: 1, Waited: 30 * time.Millisecond},
+			outcome:  store.OutcomeSkipped,
+		},
+		{
+			name:     "replicas not readable",
+			replicas: &fakeReplicas{err: errors.New("forbidden")},
+			want:     store.Probe{Outcome: store.ProbeReplicaError, PodsBefore: unknownReplicas, PodsAfter: unknownReplicas},
+			outcome:  store.OutcomeSkipped,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := coldStartConfig(config.ConfirmReplicas)
+			pool := connection.NewPoolMock(cfg)
+			sink := &memorySink{}
+			c := NewColdStartGenerator(context.Background(), cfg, discard, pool, sink, tt.replicas).(*coldStartGenerator)
+			c.lastProbe = make(map[*config.Target]time.Time)
+
+			c.probe(cfg.Targets[0], time.Time{})
+
+			results := sink.all()
+			if len(results) != 1 {
+				t.Fatalf("got %d results, expected 1", len(results))
+			}
+			r := results[0]
+			if r.Probe == nil {
+				t.Fatal("result has no probe")
+			}
+			got := *r.Probe
+			if got.Outcome != tt.want.Outcome || got.PodsBefore != tt.want.PodsBefore || got.PodsAfter != tt.want.PodsAfter {
+				t.Errorf("probe is %+v, expected %+v", got, tt.want)
+			}
+			if got.Waited < tt.want.Waited {
+				t.Errorf("waited %s, expected at least %s", got.Waited, tt.want.Waited)
+			}
+			if r.Outcome != tt.outcome {
+				t.Errorf("outcome is %s, expected %s", r.Outcome, tt.outcome)
+			}
+			if sent := pool.Targets()[cfg.Targets[0]] > 0; sent != tt.sent {
+				t.Errorf("probe sent is %v, expected %v", sent, tt.sent)
+			}
+			if !tt.sent && (r.Error == "" || r.Sent.IsZero()) {
+				t.Errorf("skipped probe has error %q and sent %s", r.Error, r.Sent)
+			}
+		})
+	}
+}
+
+func TestColdStartSkipsStaleArrivals(t *testing.T) {
+	cfg := coldStartConfig(config.ConfirmNone)
+	cfg.Rate.RequestsPerSecond = 100
+	cfg.Rate.Duration = config.Duration{Duration: 400 * time.Millisecond}
+	cfg.ColdStart.Gap = config.Duration{Duration: 40 * time.Millisecond}
+	sink := &memorySink{}
+	gen := NewColdStartGenerator(context.Background(), cfg, discard, connection.NewPoolMock(cfg), sink, nil)
+
+	if err := gen.StartColdStart(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 40 arrivals come in, but a round takes a gap
+	results := sink.all()
+	if len(results) < 2 || len(results) > 11 {
+		t.Fatalf("got %d probes in 400ms with a 40ms gap", len(results))
+	}
+	for i := 1; i < len(results); i++ {
+		if d := results[i].Sent.Sub(results[i-1].Sent); d < 40*time.Millisecond {
+			t.Errorf("probe %d was sent %s after the previous one", i, d)
+		}
+	}
+}
+
+func TestIdlePeriodStartsAfterFailedProbe(t *testing.T) {
+	// The second request times out, like a slow scale from zero
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 2 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}))
+	defer server.Close()
+
+	idle := 150 * time.Millisecond
+	cfg := coldStartConfig(config.ConfirmIdle)
+	cfg.Targets[0].URL = server.URL
+	cfg.ColdStart.IdlePeriod = config.Duration{Duration: idle}
+	pool := connection.NewPool("", 10, 10, time.Minute, 100*time.Millisecond, "")
+	sink := &memorySink{}
+	c := NewColdStartGenerator(context.Background(), cfg, discard, pool, sink, nil).(*coldStartGenerator)
+	c.lastProbe = make(map[*config.Target]time.Time)
+	target := cfg.Targets[0]
+
+	c.probe(target, time.Time{})
+	c.probe(target, time.Time{})
+	failed := time.Now()
+	c.probe(target, time.Time{})
+
+	results := sink.all()
+	if len(results) != 3 {
+		t.Fatalf("got %d results, expected 3", len(results))
+	}
+	if outcome := results[1].Probe.Outcome; outcome != store.ProbeFailed {
+		t.Fatalf("second probe is %s, expected %s", outcome, store.ProbeFailed)
+	}
+	if d := results[2].Sent.Sub(failed); d < idle {
+		t.Errorf("probe sent %s after the failed one, expected an idle period of %s", d, idle)
+	}
+}
@@ -2,49 +2,65 @@ package generator
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"hash/maphash"
 	"io"
 	"log/slog"
-	"net/http"
+	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2/event"
-	"golang.org/x/time/rate"
-
 	"github.com/luccadibe/knativeBenchmark/pkg/config"
 	"github.com/luccadibe/knativeBenchmark/pkg/connection"
+	"github.com/luccadibe/knativeBenchmark/pkg/latency"
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Generator interface {
 	Start() error
 	StartColdStart() error
+	// StartSearch looks for the highest rate that meets the configured SLO
+	StartSearch() (SearchResult, error)
 	Stop()
 	GetPool() connection.Pool
+	GetRecorder() *latency.Recorder
+	Status() Status
+	// Summary counts the requests so far, it is final once Stop returned
+	Summary() Summary
 }
 
 type generator struct {
-	cfg         *config.Config
-	Pool        connection.Pool
-	limiter     *rate.Limiter
-	ctx         context.Context
-	cancel      context.CancelFunc
-	wg          sync.WaitGroup
-	logger      *slog.Logger
-	currentRate float64
-}
-
-func New(cfg *config.Config, logger *slog.Logger, pool connection.Pool) Generator {
-	ctx, cancel := context.WithCancel(context.Background())
+	cfg      *config.Config
+	Pool     connection.Pool
+	arrivals arrivalProcess
+	selector targetSelector
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	logger   *slog.Logger
+	recorder *latency.Recorder
+	results  store.Sink
+	progress
+}
+
+// New returns the HTTP generator. It stops sending when ctx is done or Stop is called.
+// Every request is written to results.
+func New(ctx context.Context, cfg *config.Config, logger *slog.Logger, pool connection.Pool, results store.Sink) Generator {
+	ctx, cancel := context.WithCancel(ctx)
 	return &generator{
-		cfg:     cfg,
-		Pool:    pool,
-		limiter: rate.NewLimiter(rate.Limit(cfg.Rate.RequestsPerSecond), 1),
-		ctx:     ctx,
-		cancel:  cancel,
-		logger:  logger,
+		cfg:      cfg,
+		Pool:     pool,
+		ctx:      ctx,
+		cancel:   cancel,
+		logger:   logger,
+		recorder: latency.NewRecorder(),
+		results:  results,
 	}
 }
 
@@ -54,10 +70,10 @@ func (g *generator) Start() error {
 	return err
 }
 
+// StartColdStart probes without confirming scale to zero through the Kubernetes API,
+// see NewColdStartGenerator
 func (g *generator) StartColdStart() error {
-	err := g.runColdStart()
-	g.wg.Wait()
-	return err
+	return (&coldStartGenerator{generator: g}).StartColdStart()
 }
 
 func (g *generator) Stop() {
@@ -69,13 +85,39 @@ func (g *generator) GetPool() connection.Pool {
 	return g.Pool
 }
 
+func (g *generator) GetRecorder() *latency.Recorder {
+	return g.recorder
+}
+
 func (g *generator) run() error {
 	g.logger.Info("Starting workload generation", "rate", g.cfg.Rate.RequestsPerSecond)
-	if g.cfg.Rate.RequestsPerSecond == 0 {
+	selector, err := newTargetSelector(g.cfg.Rate.TargetSelection, g.cfg.Targets, g.cfg.Rate.Arrival.Seed)
+	if err != nil {
+		return err
+	}
+	g.selector = selector
+
+	if g.cfg.Rate.RequestsPerSecond == 0 && len(g.cfg.Phases) == 0 {
 		g.logger.Info("Rate 0 detected, running for maximum throughput")
 		return g.runMaxThroughput()
 	}
 
+	arrivals, err := newArrivalProcess(g.cfg.Rate.Arrival)
+	if err != nil {
+		return err
+	}
+	g.arrivals = arrivals
+
+	if len(g.cfg.Phases) > 0 {
+		requestCount, err := runPhases(g.ctx, g.logger, g.arrivals, g.cfg.Phases, g.set, g.fireAll)
+		if err != nil {
+			return err
+		}
+		g.logger.Info("All phases complete", "totalRequests", requestCount)
+		g.Stop()
+		return nil
+	}
+
 	// If its less than 1, we are in cold start mode, so we dont need the rampup
 	if g.cfg.Rate.RequestsPerSecond > 1 {
 		if err := g.rampUp(); err != nil {
@@ -83,53 +125,32 @@ func (g *generator) run() error {
 		}
 	}
 
-	interval := time.Duration(float64(time.Second) / g.cfg.Rate.RequestsPerSecond)
-	g.logger.Info("Calculated ticker interval", "interval", interval)
-
-	ticker := time.NewTicker(interval)
-	startTime := time.Now()
-	requestCount := 0
+	g.set(phaseSteady, g.cfg.Rate.RequestsPerSecond)
+	g.logger.Info("Using arrival process", "process", g.cfg.Rate.Arrival.Process, "meanInterval", time.Duration(meanInterval(g.cfg.Rate.RequestsPerSecond)))
 
-	for {
-		select {
-		case <-g.ctx.Done():
-			g.logger.Info("Generator stopped", "totalRequests", requestCount)
-			return nil
-		case <-ticker.C:
-			//g.logger.Info("Tick", "time", time.Now())
-			if err := g.limiter.Wait(g.ctx); err != nil {
-				g.logger.Error("Rate limiter error", "error", err)
-				return err
-			}
+	requestCount := schedule(g.ctx, g.arrivals, constantRate(g.cfg.Rate.RequestsPerSecond), g.cfg.Rate.Duration.Duration, func(intended time.Time) {
+		g.fireAll(intended, phaseSteady)
+	})
 
-			for _, target := range g.cfg.Targets {
-				g.wg.Add(1)
-				go func(target *config.Target) {
-					efficientLogger := g.logger.With("target", target.URL)
-					defer g.wg.Done()
-					metrics, err := g.Pool.Get(target)
-					if err != nil {
-						efficientLogger.Error("Request error", "error", err)
-						return
-					}
-					// we expect a boolean response specifying if the function is cold
-					body, err := io.ReadAll(metrics.Response.Body)
-					if err != nil {
-						efficientLogger.Error("Failed to read response body", "error", err)
-						return
-					}
-					defer metrics.Response.Body.Close()
-					efficientLogger.Info("Success", "TTFB", metrics.TTFB, "Total", metrics.Total, "isCold", string(body), "status", metrics.Response.StatusCode, "DNS", metrics.DNSTime, "Connect", metrics.ConnectTime, "TLS", metrics.TLSTime)
-					requestCount++
-				}(target)
-			}
+	if g.ctx.Err() != nil {
+		g.logger.Info("Generator stopped", "totalRequests", requestCount)
+		return nil
+	}
+	g.logger.Info("Duration reached", "duration", g.cfg.Rate.Duration.Duration, "totalRequests", requestCount)
+	g.Stop()
+	return nil
+}
 
-			if g.cfg.Rate.Duration.Duration > 0 && time.Since(startTime) > g.cfg.Rate.Duration.Duration {
-				g.logger.Info("Duration reached", "duration", g.cfg.Rate.Duration.Duration)
-				g.Stop()
-				return nil
+// fireAll sends one concurrent request to every target picked by the selector
+func (g *generator) fireAll(intended time.Time, phase string) {
+	for _, target := range g.selector.next() {
+		g.wg.Add(1)
+		go func(t *config.Target) {
+			defer g.wg.Done()
+			if _, err := g.sendRequest(t, intended, phase); err != nil && g.ctx.Err() == nil {
+				g.logger.Error("Request failed", "error", err)
 			}
-		}
+		}(target)
 	}
 }
 
@@ -142,122 +163,196 @@ func (g *generator) rampUp() error {
 
 	steps := 15 // one step per second
 	rateIncrement := (g.cfg.Rate.RequestsPerSecond - 1) / float64(steps)
-	currentRate := 1.0
-
-	for i := 0; i < steps; i++ {
-		select {
-		case <-g.ctx.Done():
-			return nil
-		default:
-			currentRate += rateIncrement
-			// Calculate appropriate burst size based on rate
-			burstSize := int(currentRate)
-			if burstSize < 1 {
-				burstSize = 1
-			}
-
-			localRateLimiter := rate.NewLimiter(rate.Limit(currentRate), burstSize)
-			g.currentRate = currentRate
-
-			// Create a ticker for the current rate
-			interval := time.Duration(float64(time.Second) / currentRate)
-			ticker := time.NewTicker(interval)
-			defer ticker.Stop()
-
-			stepTimer := time.NewTimer(time.Second)
-			defer stepTimer.Stop()
-
-		stepLoop:
-			for {
-				select {
-				case <-g.ctx.Done():
-					return nil
-				case <-stepTimer.C:
-					break stepLoop
-				case <-ticker.C:
-					if err := localRateLimiter.Wait(g.ctx); err != nil {
-						return err
-					}
-
-					// Launch concurrent requests for each target
-					for _, target := range g.cfg.Targets {
-						g.wg.Add(1)
-						go func(t *config.Target) {
-							defer g.wg.Done()
-							if err := g.sendRequest(t); err != nil {
-								g.logger.Error("Request failed", "error", err)
-							}
-						}(target)
-					}
-				}
-			}
-
-			g.logger.Info("Ramp-up progress", "currentRate", currentRate)
-		}
+	rampRate := func(elapsed time.Duration) float64 {
+		step := int(elapsed / time.Second)
+		rate := 1 + rateIncrement*float64(step+1)
+		g.set(phaseRampUp, rate)
+		return rate
 	}
 
+	schedule(g.ctx, g.arrivals, rampRate, time.Duration(steps)*time.Second, func(intended time.Time) {
+		g.fireAll(intended, phaseRampUp)
+	})
+
 	g.logger.Info("Ramp-up complete")
 	return nil
 }
 
-func (g *generator) runColdStart() error {
-	interval := time.Duration(float64(time.Second) / g.cfg.Rate.RequestsPerSecond)
-	g.logger.Info("Calculated ticker interval", "interval", interval)
-
-	ticker := time.NewTicker(interval)
-	startTime := time.Now()
-
-	for {
-		select {
-		case <-g.ctx.Done():
-			g.logger.Info("Generator stopped")
-			return nil
-		case <-ticker.C:
-			for _, target := range g.cfg.Targets {
-				// Sequential requests, sleep between each
-				if err := g.sendRequest(target); err != nil {
-					g.logger.Error("Request failed", "error", err)
-				}
-				time.Sleep(time.Second * 7)
-			}
-			if g.cfg.Rate.Duration.Duration > 0 && time.Since(startTime) > g.cfg.Rate.Duration.Duration {
-				g.logger.Info("Duration reached", "duration", g.cfg.Rate.Duration.Duration)
-				g.Stop()
-				return nil
-			}
-		}
+// sendRequest sends one request and writes its result. The returned metrics are only
+// valid for the timings and status, the body has been read and closed. A failed
+// request returns the timings it got to with its error, if it was sent.
+// Requests that are due after the generator was stopped are not sent.
+func (g *generator) sendRequest(target *config.Target, intended time.Time, phase string) (*connection.ResponseMetrics, error) {
+	result, metrics, err := g.attempt(target, intended, phase)
+	if result != nil {
+		writeResult(g.results, g.logger, *result)
 	}
+	return metrics, err
 }
 
-func (g *generator) sendRequest(target *config.Target) error {
-	efficientLogger := g.logger.With("target", target.URL)
-	metrics, err := g.Pool.Get(target)
+// attempt is sendRequest without writing the result, which is nil if the request was not sent
+func (g *generator) attempt(target *config.Target, intended time.Time, phase string) (*store.Result, *connection.ResponseMetrics, error) {
+	g.planned.Add(1)
+	if g.ctx.Err() != nil {
+		return nil, nil, g.ctx.Err()
+	}
+	efficientLogger := g.logger.With("target", target.URL, "phase", phase)
+	result := newResult(g.cfg, target, intended, phase)
+	result.Sent = time.Now()
+	g.sent.Add(1)
+	metrics, err := send(g.Pool, target)
+	g.completed.Add(1)
 	if err != nil {
-		efficientLogger.Error("Request error", "error", err)
-		return err
+		withMetrics(&result, metrics)
+		failed(&result, store.ErrorRequest, err)
+		record(g.recorder, result, metrics)
+		efficientLogger.Error("Request error", "error", err, "elapsed", result.Total, "intended", formatTime(intended), "sent", formatTime(result.Sent))
+		return &result, metrics, err
 	}
+	withMetrics(&result, metrics)
 
 	body, err := io.ReadAll(metrics.Response.Body)
+	metrics.Response.Body.Close()
 	if err != nil {
+		failed(&result, store.ErrorBody, err)
+		record(g.recorder, result, metrics)
 		efficientLogger.Error("Failed to read response body", "error", err)
-		return err
+		return &result, metrics, err
+	}
+	result.Cold = isCold(body)
+	checkResponse(&result, target, metrics, body)
+	record(g.recorder, result, metrics)
+	logResponse(efficientLogger, result, metrics)
+
+	return &result, metrics, nil
+}
+
+// newResult starts the result of a request, labelled with the experiment of cfg
+func newResult(cfg *config.Config, target *config.Target, intended time.Time, phase string) store.Result {
+	return store.Result{
+		Target:     target.URL,
+		Intended:   intended,
+		Phase:      phase,
+		Experiment: cfg.Experiment.Name,
+		Scenario:   cfg.Experiment.Scenario,
+		Params:     cfg.Experiment.Params,
+	}
+}
+
+// send makes the request target's type needs
+func send(pool connection.Pool, target *config.Target) (*connection.ResponseMetrics, error) {
+	if target.Type == config.TargetGRPC {
+		return pool.Invoke(target)
 	}
-	defer metrics.Response.Body.Close()
+	return pool.Send(target)
+}
 
-	efficientLogger.Info("Success",
-		"TTFB", metrics.TTFB,
-		"Total", metrics.Total,
-		"isCold", string(body),
-		"status", metrics.Response.StatusCode,
-		"DNS", metrics.DNSTime,
-		"Connect", metrics.ConnectTime,
-		"TLS", metrics.TLSTime)
+// record adds a request to the latency histograms: a response by its latency,
+// whatever its outcome, and a request that got no whole response by its
+// outcome and the time until it failed. Requests that were not sent, or were
+// cancelled at the end of the run, are left out.
+func record(recorder *latency.Recorder, result store.Result, metrics *connection.ResponseMetrics) {
+	switch {
+	case metrics == nil || result.ErrorKind == connection.KindCanceled:
+	case result.ErrorClass == store.ErrorRequest || result.ErrorClass == store.ErrorBody:
+		recorder.RecordFailure(result.Target, result.Outcome, result.Total)
+	default:
+		recorder.Record(result.Target, result.Intended, result.Sent, result.TTFB, result.Total)
+	}
+}
 
-	return nil
+// withMetrics copies the status and timings of a response into result. A failed
+// request has only the timings it got to, and no metrics if it was not sent.
+func withMetrics(result *store.Result, metrics *connection.ResponseMetrics) {
+	if metrics == nil {
+		return
+	}
+	if metrics.Response != nil {
+		result.Status = metrics.Response.StatusCode
+		result.Protocol = metrics.Response.Proto
+	}
+	if st := metrics.GRPCStatus; st != nil {
+		result.GRPCStatus = st.Code().String()
+		if st.Code() != codes.OK {
+			result.Error = st.Message()
+		}
+	}
+	result.TTFB = metrics.TTFB
+	result.Total = metrics.Total
+	result.DNS = metrics.DNSTime
+	result.Connect = metrics.ConnectTime
+	result.TLS = metrics.TLSTime
+}
+
+// checkResponse sets the outcome of a response to target from its expect rules
+func checkResponse(result *store.Result, target *config.Target, metrics *connection.ResponseMetrics, body []byte) {
+	err := target.Check(metrics.Response, body, metrics.Total)
+	var statusErr *config.StatusError
+	switch {
+	case err == nil:
+		result.Outcome = store.OutcomeOK
+	case errors.As(err, &statusErr):
+		result.ErrorClass, result.Outcome = store.ErrorStatus, store.OutcomeHTTPError
+		// grpc calls already carry their status message
+		if result.Error == "" {
+			result.Error = err.Error()
+		}
+	default:
+		result.ErrorClass, result.Outcome, result.Error = store.ErrorAssertion, store.OutcomeAssertionFailed, err.Error()
+	}
+}
+
+// failed records err, which kept the request from getting a whole response
+func failed(result *store.Result, class string, err error) {
+	result.ErrorClass, result.Error = class, err.Error()
+	result.ErrorKind = connection.KindOf(err)
+	if class == store.ErrorBody {
+		result.ErrorKind = connection.KindBodyRead
+	}
+	result.Outcome = store.OutcomeConnError
+	if isTimeout(err) {
+		result.Outcome = store.OutcomeTimeout
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) ||
+		status.Code(err) == codes.DeadlineExceeded
+}
+
+// logResponse logs a response, at warn level if it is not ok
+func logResponse(logger *slog.Logger, result store.Result, metrics *connection.ResponseMetrics) {
+	if result.Outcome != store.OutcomeOK {
+		logger.Warn("Unexpected response", "outcome", result.Outcome, "error", result.Error, "status", result.Status, "TTFB", metrics.TTFB)
+		return
+	}
+	logger.Debug("Success", "TTFB", metrics.TTFB, "status", result.Status)
+}
+
+// isCold reads the body of the functions, which is true on a cold start.
+// Some functions return it as a JSON string.
+func isCold(body []byte) bool {
+	return strings.EqualFold(strings.Trim(strings.TrimSpace(string(body)), `"`), "true")
+}
+
+// writeResult hands result to the sink, a failing sink is logged but does not fail the request
+func writeResult(sink store.Sink, logger *slog.Logger, result store.Result) {
+	if err := sink.Write(result); err != nil {
+		logger.Error("Failed to write result", "error", err)
+	}
+}
+
+// formatTime keeps the full precision of send timestamps in the log,
+// slog's text handler would truncate them to milliseconds
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
 }
 
 func (g *generator) runMaxThroughput() error {
 	startTime := time.Now()
+	g.set(phaseSteady, 0)
 
 	for {
 		select {
@@ -265,26 +360,12 @@ func (g *generator) runMaxThroughput() error {
 			g.logger.Info("Generator stopped")
 			return nil
 		default:
-			for _, target := range g.cfg.Targets {
+			for _, target := range g.selector.next() {
 				g.wg.Add(1)
 				go func(target *config.Target) {
-					efficientLogger := g.logger.With("target", target.URL)
 					defer g.wg.Done()
-					metrics, err := g.Pool.Get(target)
-					if err != nil {
-						efficientLogger.Error("Request error", "error", err)
-						return
-					}
-					if metrics.Response.StatusCode != http.StatusOK {
-						efficientLogger.Error("Failed", "status", metrics.Response.StatusCode, "TTFB", metrics.TTFB, "Total", metrics.Total, "DNS", metrics.DNSTime, "Connect", metrics.ConnectTime, "TLS", metrics.TLSTime)
-						return
-					}
-					body, err := io.ReadAll(metrics.Response.Body)
-					if err != nil {
-						efficientLogger.Error("Failed to read response body", "error", err)
-					}
-					efficientLogger.Info("Success", "TTFB", metrics.TTFB, "Total", metrics.Total, "isCold", string(body), "status", metrics.Response.StatusCode, "DNS", metrics.DNSTime, "Connect", metrics.ConnectTime, "TLS", metrics.TLSTime)
-
+					// There is no schedule at max throughput, so the intended time is the send time
+					g.sendRequest(target, time.Now(), phaseSteady)
 				}(target)
 			}
 
@@ -300,15 +381,17 @@ func (g *generator) runMaxThroughput() error {
 var _ Generator = &cloudEventGenerator{}
 
 type cloudEventGenerator struct {
-	cfg         *config.Config
-	event       *cloudevents.Event
-	Pool        connection.Pool
-	limiter     *rate.Limiter
-	ctx         context.Context
-	cancel      context.CancelFunc
-	wg          sync.WaitGroup
-	logger      *slog.Logger
-	currentRate float64
+	cfg      *config.Config
+	event    *cloudevents.Event
+	Pool     connection.Pool
+	arrivals arrivalProcess
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	logger   *slog.Logger
+	recorder *latency.Recorder
+	results  store.Sink
+	progress
 }
 
 // GetPool implements Generator.
@@ -316,6 +399,11 @@ func (c *cloudEventGenerator) GetPool() connection.Pool {
 	return c.Pool
 }
 
+// GetRecorder implements Generator.
+func (c *cloudEventGenerator) GetRecorder() *latency.Recorder {
+	return c.recorder
+}
+
 // Start implements Generator.
 func (c *cloudEventGenerator) Start() error {
 	err := c.run()
@@ -329,15 +417,18 @@ func (c *cloudEventGenerator) Stop() {
 	c.wg.Wait()
 }
 
-func NewCloudEventGenerator(cfg *config.Config, event *cloudevents.Event, pool connection.Pool, logger *slog.Logger) Generator {
-	ctx, cancel := context.WithCancel(context.Background())
+// NewCloudEventGenerator returns the CloudEvent generator. It stops sending when ctx is done or Stop is called.
+func NewCloudEventGenerator(ctx context.Context, cfg *config.Config, event *cloudevents.Event, pool connection.Pool, logger *slog.Logger, results store.Sink) Generator {
+	ctx, cancel := context.WithCancel(ctx)
 	return &cloudEventGenerator{
-		cfg:    cfg,
-		event:  event,
-		Pool:   pool,
-		ctx:    ctx,
-		cancel: cancel,
-		logger: logger,
+		cfg:      cfg,
+		event:    event,
+		Pool:     pool,
+		ctx:      ctx,
+		cancel:   cancel,
+		logger:   logger,
+		recorder: latency.NewRecorder(),
+		results:  results,
 	}
 }
 
@@ -346,67 +437,54 @@ func (c *cloudEventGenerator) run() error {
 	c.logger.Info("Starting workload generation", "rate", c.cfg.Rate.RequestsPerSecond)
 	c.logger.Info("Using cloudevent", "event", c.event)
 
-	interval := time.Duration(float64(time.Second) / c.cfg.Rate.RequestsPerSecond)
-	c.logger.Info("Calculated ticker interval", "interval", interval)
-
-	if c.cfg.Rate.RequestsPerSecond > 1 {
-		if err := c.rampUp(); err != nil {
-			return fmt.Errorf("ramp-up failed: %w", err)
-		}
+	arrivals, err := newArrivalProcess(c.cfg.Rate.Arrival)
+	if err != nil {
+		return err
 	}
+	c.arrivals = arrivals
+	c.logger.Info("Using arrival process", "process", c.cfg.Rate.Arrival.Process, "meanInterval", time.Duration(meanInterval(c.cfg.Rate.RequestsPerSecond)))
 
-	ticker := time.NewTicker(interval)
-	startTime := time.Now()
 	target := c.cfg.Targets[0]
-	efficientLogger := c.logger.With("target", target.URL)
-	for {
-		select {
-		case <-c.ctx.Done():
-			c.logger.Info("Generator stopped")
-			return nil
-		case <-ticker.C:
+	if len(c.cfg.Phases) > 0 {
+		requestCount, err := runPhases(c.ctx, c.logger, c.arrivals, c.cfg.Phases, c.set, func(intended time.Time, phase string) {
 			c.wg.Add(1)
-			go func(target *config.Target) {
+			go func() {
 				defer c.wg.Done()
-				// A unique id allows per request comparison
-				// There should be no problem with concurrency here
-				id := strconv.Itoa(int(new(maphash.Hash).Sum64()))
-				event := c.event.Clone()
-				event.SetID(id)
-
-				metrics, err := c.Pool.GenerateCloudEvent(target, &event)
-				if err != nil {
-					if metrics == nil {
-						efficientLogger.Error("Failed with no metrics", "error", err)
-						return
-					}
-					efficientLogger.Error("Failed",
-						"id", id,
-						"error", err,
-						"TTFB", metrics.TTFB,
-						"Total", metrics.Total,
-						"DNS", metrics.DNSTime,
-						"Connect", metrics.ConnectTime,
-						"TLS", metrics.TLSTime,
-					)
-					return
-				}
-				body, err := io.ReadAll(metrics.Response.Body)
-				if err != nil {
-					efficientLogger.Error("Failed to read response body", "error", err)
-				}
-				defer metrics.Response.Body.Close()
-				efficientLogger.Info("Success", "id", id, "TTFB", metrics.TTFB, "Total", metrics.Total, "isCold", string(body), "status", metrics.Response.StatusCode, "DNS", metrics.DNSTime, "Connect", metrics.ConnectTime, "TLS", metrics.TLSTime)
-			}(target)
+				c.sendRequest(target, intended, phase)
+			}()
+		})
+		if err != nil {
+			return err
 		}
-		if c.cfg.Rate.Duration.Duration > 0 && time.Since(startTime) > c.cfg.Rate.Duration.Duration {
-			c.logger.Info("Duration reached", "duration", c.cfg.Rate.Duration.Duration)
-			c.Stop()
-			return nil
+		c.logger.Info("All phases complete", "totalRequests", requestCount)
+		c.Stop()
+		return nil
+	}
+
+	if c.cfg.Rate.RequestsPerSecond > 1 {
+		if err := c.rampUp(); err != nil {
+			return fmt.Errorf("ramp-up failed: %w", err)
 		}
 	}
 
+	c.set(phaseSteady, c.cfg.Rate.RequestsPerSecond)
+	schedule(c.ctx, c.arrivals, constantRate(c.cfg.Rate.RequestsPerSecond), c.cfg.Rate.Duration.Duration, func(intended time.Time) {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.sendRequest(target, intended, phaseSteady)
+		}()
+	})
+
+	if c.ctx.Err() != nil {
+		c.logger.Info("Generator stopped")
+		return nil
+	}
+	c.logger.Info("Duration reached", "duration", c.cfg.Rate.Duration.Duration)
+	c.Stop()
+	return nil
 }
+
 func (c *cloudEventGenerator) rampUp() error {
 	if c.cfg.Rate.RequestsPerSecond <= 1 {
 		return nil
@@ -416,93 +494,100 @@ func (c *cloudEventGenerator) rampUp() error {
 
 	steps := 15 // one step per second
 	rateIncrement := (c.cfg.Rate.RequestsPerSecond - 1) / float64(steps)
-	currentRate := 1.0
-
-	for i := 0; i < steps; i++ {
-		select {
-		case <-c.ctx.Done():
-			return nil
-		default:
-			currentRate += rateIncrement
-			// Calculate appropriate burst size based on rate
-			burstSize := int(currentRate)
-			if burstSize < 1 {
-				burstSize = 1
-			}
-
-			localRateLimiter := rate.NewLimiter(rate.Limit(currentRate), burstSize)
-			c.currentRate = currentRate
-
-			// Create a ticker for the current rate
-			interval := time.Duration(float64(time.Second) / currentRate)
-			ticker := time.NewTicker(interval)
-			defer ticker.Stop()
-
-			stepTimer := time.NewTimer(time.Second)
-			defer stepTimer.Stop()
-
-		stepLoop:
-			for {
-				select {
-				case <-c.ctx.Done():
-					return nil
-				case <-stepTimer.C:
-					break stepLoop
-				case <-ticker.C:
-					if err := localRateLimiter.Wait(c.ctx); err != nil {
-						return err
-					}
-
-					// Launch concurrent requests for each target
-					for _, target := range c.cfg.Targets {
-						c.wg.Add(1)
-						go func(t *config.Target) {
-							defer c.wg.Done()
-							if err := c.sendRequest(t); err != nil {
-								c.logger.Error("Request failed", "error", err)
-							}
-						}(target)
-					}
-				}
-			}
+	rampRate := func(elapsed time.Duration) float64 {
+		step := int(elapsed / time.Second)
+		rate := 1 + rateIncrement*float64(step+1)
+		c.set(phaseRampUp, rate)
+		return rate
+	}
 
-			c.logger.Info("Ramp-up progress", "currentRate", currentRate)
+	schedule(c.ctx, c.arrivals, rampRate, time.Duration(steps)*time.Second, func(intended time.Time) {
+		// Launch concurrent requests for each target
+		for _, target := range c.cfg.Targets {
+			c.wg.Add(1)
+			go func(t *config.Target) {
+				defer c.wg.Done()
+				c.sendRequest(t, intended, phaseRampUp)
+			}(target)
 		}
-	}
+	})
 
 	c.logger.Info("Ramp-up complete")
 	return nil
 }
 
-func (c *cloudEventGenerator) sendRequest(target *config.Target) error {
+func (c *cloudEventGenerator) sendRequest(target *config.Target, intended time.Time, phase string) {
+	c.planned.Add(1)
+	if c.ctx.Err() != nil {
+		return
+	}
+	// A unique id allows per request comparison
+	// There should be no problem with concurrency here
 	id := strconv.Itoa(int(new(maphash.Hash).Sum64()))
 	event := c.event.Clone()
 	event.SetID(id)
-	efficientLogger := c.logger.With("target", target.URL)
+	efficientLogger := c.logger.With("target", target.URL, "phase", phase, "id", id)
+	result := newResult(c.cfg, target, intended, phase)
+	result.EventID = id
+	if err := renderEvent(&event, target); err != nil {
+		failed(&result, store.ErrorRequest, err)
+		writeResult(c.results, c.logger, result)
+		efficientLogger.Error("Failed to render event", "error", err)
+		return
+	}
+
+	result.Sent = time.Now()
+	c.sent.Add(1)
 	metrics, err := c.Pool.GenerateCloudEvent(target, &event)
+	c.completed.Add(1)
 	if err != nil {
-		efficientLogger.Error("Request error", "error", err)
-		return err
+		withMetrics(&result, metrics)
+		failed(&result, store.ErrorRequest, err)
+		record(c.recorder, result, metrics)
+		writeResult(c.results, c.logger, result)
+		efficientLogger.Error("Failed", "error", err, "elapsed", result.Total, "intended", formatTime(intended), "sent", formatTime(result.Sent))
+		return
 	}
-
+	withMetrics(&result, metrics)
 	body, err := io.ReadAll(metrics.Response.Body)
+	metrics.Response.Body.Close()
 	if err != nil {
+		failed(&result, store.ErrorBody, err)
 		efficientLogger.Error("Failed to read response body", "error", err)
-		return err
 	}
-	defer metrics.Response.Body.Close()
-
-	efficientLogger.Info("Success",
-		"id", id,
-		"TTFB", metrics.TTFB,
-		"Total", metrics.Total,
-		"isCold", string(body),
-		"status", metrics.Response.StatusCode,
-		"DNS", metrics.DNSTime,
-		"Connect", metrics.ConnectTime,
-		"TLS", metrics.TLSTime)
+	result.Cold = isCold(body)
+	if err == nil {
+		checkResponse(&result, target, metrics, body)
+	}
+	record(c.recorder, result, metrics)
+	writeResult(c.results, c.logger, result)
+	if err == nil {
+		logResponse(efficientLogger, result, metrics)
+	}
+}
 
-	return nil
+// renderEvent executes the templates of the target into the event. The source,
+// type and data of the event come from the ce-source and ce-type headers and the body.
+// Without a Content-Type header the data keeps the content type of the event, or JSON.
+func renderEvent(event *cloudevents.Event, target *config.Target) error {
+	if !target.Templated() {
+		return nil
+	}
+	headers, body, err := target.Render()
+	if err != nil {
+		return err
+	}
+	event.SetSource(headers["ce-source"])
+	event.SetType(headers["ce-type"])
+	contentType := headers["Content-Type"]
+	if contentType == "" {
+		contentType = event.DataContentType()
+	}
+	if contentType == "" {
+		contentType = cloudevents.ApplicationJSON
+	}
+	// The body is already encoded, as bytes the codec keeps it as is
+	return event.SetData(contentType, []byte(body))
 }
 
 func (c *cloudEventGenerator) runColdStart() error {
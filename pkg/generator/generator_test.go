@@ -0,0 +1,137 @@
+package generator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/luccadibe/knativeBenchmark/pkg/connection"
+	"github.com/luccadibe/knativeBenchmark/pkg/latency"
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+)
+
+// counts returns the number of values per metric the recorder has for target
+func counts(recorder *latency.Recorder, target string) map[string]int64 {
+	n := make(map[string]int64)
+	for _, e := range recorder.Snapshot().Entries() {
+		if e.Target == target {
+			n[e.Metric] = e.Histogram.TotalCount()
+		}
+	}
+	return n
+}
+
+func TestEveryAttemptIsRecorded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/slow":
+			time.Sleep(300 * time.Millisecond)
+		case "/truncated":
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("true"))
+		}
+	}))
+	defer server.Close()
+	// Nothing listens on a port that was just closed
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		outcome string
+		// metric is the histogram the request goes to
+		metric string
+	}{
+		{name: "ok", url: server.URL + "/", outcome: store.OutcomeOK, metric: latency.Total},
+		{name: "unexpected status", url: server.URL + "/unavailable", outcome: store.OutcomeHTTPError, metric: latency.Total},
+		{name: "refused", url: closed.URL + "/", outcome: store.OutcomeConnError, metric: latency.Failed(store.OutcomeConnError)},
+		{name: "timeout", url: server.URL + "/slow", outcome: store.OutcomeTimeout, metric: latency.Failed(store.OutcomeTimeout)},
+		{name: "truncated body", url: server.URL + "/truncated", outcome: store.OutcomeConnError, metric: latency.Failed(store.OutcomeConnError)},
+	}
+	send := map[string]func(cfg *config.Config, pool connection.Pool, sink store.Sink) (func(*config.Target), *latency.Recorder){
+		"http": func(cfg *config.Config, pool connection.Pool, sink store.Sink) (func(*config.Target), *latency.Recorder) {
+			g := New(context.Background(), cfg, discard, pool, sink).(*generator)
+			return func(target *config.Target) { g.sendRequest(target, time.Now(), phaseSteady) }, g.recorder
+		},
+		"cloudevent": func(cfg *config.Config, pool connection.Pool, sink store.Sink) (func(*config.Target), *latency.Recorder) {
+			event := cloudevents.NewEvent()
+			event.SetID("1")
+			event.SetSource("test")
+			event.SetType("test")
+			g := NewCloudEventGenerator(context.Background(), cfg, &event, pool, discard, sink).(*cloudEventGenerator)
+			return func(target *config.Target) { g.sendRequest(target, time.Now(), phaseSteady) }, g.recorder
+		},
+	}
+	for path, newSend := range send {
+		for _, tt := range tests {
+			t.Run(path+"/"+tt.name, func(t *testing.T) {
+				target := &config.Target{URL: tt.url, Weight: 1}
+				cfg := &config.Config{Targets: []*config.Target{target}}
+				sink := &memorySink{}
+				pool := connection.NewPool("", 10, 10, time.Minute, 100*time.Millisecond, "")
+				send, recorder := newSend(cfg, pool, sink)
+
+				send(target)
+
+				results := sink.all()
+				if len(results) != 1 || results[0].Outcome != tt.outcome {
+					t.Fatalf("results are %+v, expected one with outcome %s", results, tt.outcome)
+				}
+				got := counts(recorder, tt.url)
+				if got[tt.metric] != 1 {
+					t.Errorf("recorded %v, expected one value in %s", got, tt.metric)
+				}
+				if tt.metric != latency.Total && len(got) != 1 {
+					t.Errorf("recorded %v, a failed request only goes to %s", got, tt.metric)
+				}
+			})
+		}
+	}
+}
+
+func TestRenderEventContentType(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		base    string
+		wantTyp string
+	}{
+		{name: "header", header: "\n      Content-Type: text/plain", base: "application/xml", wantTyp: "text/plain"},
+		{name: "event", base: "application/xml", wantTyp: "application/xml"},
+		{name: "default", wantTyp: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			text := "targets:\n  - url: http://hello.functions.example.com\n    body: '{\"seq\": {{.Seq}}}'\n" +
+				"    headers:\n      ce-source: test\n      ce-type: test" + tt.header + "\n"
+			if err := os.WriteFile(path, []byte(text), 0666); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := config.Load(path, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			event := cloudevents.NewEvent()
+			if tt.base != "" {
+				event.SetDataContentType(tt.base)
+			}
+
+			if err := renderEvent(&event, cfg.Targets[0]); err != nil {
+				t.Fatal(err)
+			}
+			if event.DataContentType() != tt.wantTyp || string(event.Data()) != `{"seq": 1}` {
+				t.Errorf("event has data %q of type %q, expected type %q", event.Data(), event.DataContentType(), tt.wantTyp)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package generator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+// Phase names used when no phases are configured
+const (
+	phaseRampUp = "ramp-up"
+	phaseSteady = "steady"
+)
+
+// phaseRate returns the rateAt function for schedule that implements the phase's shape
+func phaseRate(p config.Phase) (func(time.Duration) float64, error) {
+	duration := p.Duration.Duration
+	if duration <= 0 {
+		return nil, fmt.Errorf("phase %q: duration must be positive", p.Name)
+	}
+
+	switch p.Shape {
+	case "", config.ShapeConstant:
+		return constantRate(p.Rate), nil
+	case config.ShapeRamp:
+		return func(elapsed time.Duration) float64 {
+			return p.From + (p.To-p.From)*float64(elapsed)/float64(duration)
+		}, nil
+	case config.ShapeStep:
+		if p.Steps < 1 {
+			return nil, fmt.Errorf("phase %q: step shape needs at least 1 step", p.Name)
+		}
+		stepLength := duration / time.Duration(p.Steps)
+		return func(elapsed time.Duration) float64 {
+			if p.Steps == 1 {
+				return p.From
+			}
+			step := min(int(elapsed/stepLength), p.Steps-1)
+			return p.From + (p.To-p.From)*float64(step)/float64(p.Steps-1)
+		}, nil
+	case config.ShapeSpike:
+		spikeStart := p.SpikeAt.Duration
+		spikeEnd := spikeStart + p.SpikeDuration.Duration
+		return func(elapsed time.Duration) float64 {
+			if elapsed >= spikeStart && elapsed < spikeEnd {
+				return p.Peak
+			}
+			return p.Rate
+		}, nil
+	case config.ShapeSine:
+		if p.Period.Duration <= 0 {
+			return nil, fmt.Errorf("phase %q: sine shape needs a positive period", p.Name)
+		}
+		return func(elapsed time.Duration) float64 {
+			return p.Rate + p.Amplitude*math.Sin(2*math.Pi*float64(elapsed)/float64(p.Period.Duration))
+		}, nil
+	default:
+		return nil, fmt.Errorf("phase %q: unknown shape %q", p.Name, p.Shape)
+	}
+}
+
+// runPhases runs every phase in order on the same arrival process.
+// report is called with the current phase and rate whenever the rate is evaluated,
+// fire receives the name of the phase the arrival belongs to.
+// It returns the total number of arrivals.
+func runPhases(ctx context.Context, logger *slog.Logger, arrivals arrivalProcess, phases []config.Phase, report func(phase string, rate float64), fire func(intended time.Time, phase string)) (int, error) {
+	// Validate everything up front so a typo in the last phase does not fail a long run
+	rates := make([]func(time.Duration) float64, len(phases))
+	for i, p := range phases {
+		rateAt, err := phaseRate(p)
+		if err != nil {
+			return 0, err
+		}
+		rates[i] = rateAt
+	}
+
+	total := 0
+	for i, p := range phases {
+		name := p.Name
+		if name == "" {
+			name = fmt.Sprintf("phase-%d", i)
+		}
+		logger.Info("Starting phase", "phase", name, "shape", p.Shape, "duration", p.Duration.Duration)
+		rateAt := func(elapsed time.Duration) float64 {
+			rate := rates[i](elapsed)
+			report(name, rate)
+			return rate
+		}
+		count := schedule(ctx, arrivals, rateAt, p.Duration.Duration, func(intended time.Time) {
+			fire(intended, name)
+		})
+		total += count
+		logger.Info("Phase complete", "phase", name, "requests", count)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,163 @@
+package generator
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+func seconds(s float64) config.Duration {
+	return config.Duration{Duration: time.Duration(s * float64(time.Second))}
+}
+
+func TestPhaseRate(t *testing.T) {
+	tests := []struct {
+		name  string
+		phase config.Phase
+		// want maps the elapsed time to the rate at that time
+		want map[time.Duration]float64
+	}{
+		{
+			name:  "constant",
+			phase: config.Phase{Duration: seconds(10), Rate: 25},
+			want:  map[time.Duration]float64{0: 25, 10 * time.Second: 25},
+		},
+		{
+			name:  "ramp",
+			phase: config.Phase{Duration: seconds(10), Shape: config.ShapeRamp, From: 10, To: 110},
+			want:  map[time.Duration]float64{0: 10, 5 * time.Second: 60, 10 * time.Second: 110},
+		},
+		{
+			name:  "ramp down",
+			phase: config.Phase{Duration: seconds(10), Shape: config.ShapeRamp, From: 100, To: 0},
+			want:  map[time.Duration]float64{0: 100, 2500 * time.Millisecond: 75, 10 * time.Second: 0},
+		},
+		{
+			name:  "step",
+			phase: config.Phase{Duration: seconds(4), Shape: config.ShapeStep, From: 10, To: 40, Steps: 4},
+			want: map[time.Duration]float64{
+				0:                      10,
+				time.Second - 1:        10,
+				time.Second:            20,
+				3*time.Second - 1:      30,
+				3 * time.Second:        40,
+				4 * time.Second:        40,
+				4*time.Second + 100000: 40,
+			},
+		},
+		{
+			name:  "single step",
+			phase: config.Phase{Duration: seconds(4), Shape: config.ShapeStep, From: 10, To: 40, Steps: 1},
+			want:  map[time.Duration]float64{0: 10, 4 * time.Second: 10},
+		},
+		{
+			name:  "spike",
+			phase: config.Phase{Duration: seconds(10), Shape: config.ShapeSpike, Rate: 5, Peak: 50, SpikeAt: seconds(4), SpikeDuration: seconds(2)},
+			want: map[time.Duration]float64{
+				0:                 5,
+				4*time.Second - 1: 5,
+				4 * time.Second:   50,
+				6*time.Second - 1: 50,
+				6 * time.Second:   5,
+			},
+		},
+		{
+			name:  "sine",
+			phase: config.Phase{Duration: seconds(20), Shape: config.ShapeSine, Rate: 50, Amplitude: 20, Period: seconds(8)},
+			want: map[time.Duration]float64{
+				0:                50,
+				2 * time.Second:  70,
+				4 * time.Second:  50,
+				6 * time.Second:  30,
+				8 * time.Second:  50,
+				10 * time.Second: 70,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rateAt, err := phaseRate(tt.phase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for elapsed, want := range tt.want {
+				if got := rateAt(elapsed); math.Abs(got-want) > 1e-9 {
+					t.Errorf("rate after %s is %v, expected %v", elapsed, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPhaseRateRejects(t *testing.T) {
+	for _, p := range []config.Phase{
+		{Name: "no duration", Rate: 10},
+		{Name: "no steps", Duration: seconds(10), Shape: config.ShapeStep, From: 1, To: 2},
+		{Name: "no period", Duration: seconds(10), Shape: config.ShapeSine, Rate: 10, Amplitude: 5},
+		{Name: "unknown", Duration: seconds(10), Shape: "square"},
+	} {
+		if _, err := phaseRate(p); err == nil {
+			t.Errorf("phase %q was accepted", p.Name)
+		}
+	}
+}
+
+// arrivalsOf counts the arrivals schedule fires over duration, stepping
+// through the intended times as it does without waiting for them
+func arrivalsOf(arrivals arrivalProcess, rateAt func(time.Duration) float64, duration time.Duration) int {
+	count := 0
+	for elapsed := time.Duration(0); ; {
+		rate := rateAt(elapsed)
+		if rate <= 0 {
+			elapsed += rateCheck
+			continue
+		}
+		next, due := advance(arrivals, rateAt, elapsed, rate, duration)
+		if next >= duration {
+			return count
+		}
+		if due {
+			count++
+		}
+		elapsed = next
+	}
+}
+
+func TestPhaseMeanInterArrivalTime(t *testing.T) {
+	tests := []struct {
+		name  string
+		phase config.Phase
+		// want is the integral of the rate over the phase
+		want float64
+	}{
+		{name: "ramp", phase: config.Phase{Duration: seconds(100), Shape: config.ShapeRamp, From: 0, To: 100}, want: 5000},
+		{name: "step", phase: config.Phase{Duration: seconds(100), Shape: config.ShapeStep, From: 20, To: 80, Steps: 4}, want: 5000},
+		{name: "spike", phase: config.Phase{Duration: seconds(100), Shape: config.ShapeSpike, Rate: 40, Peak: 240, SpikeAt: seconds(50), SpikeDuration: seconds(5)}, want: 5000},
+		// Whole periods of the sine add up to its mean rate
+		{name: "sine", phase: config.Phase{Duration: seconds(100), Shape: config.ShapeSine, Rate: 50, Amplitude: 40, Period: seconds(20)}, want: 5000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rateAt, err := phaseRate(tt.phase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			arrivals, err := newArrivalProcess(config.Arrival{Process: config.ArrivalPoisson, Seed: 7})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := arrivalsOf(arrivals, rateAt, tt.phase.Duration.Duration)
+			if math.Abs(float64(got)/tt.want-1) > 0.03 {
+				t.Errorf("%d arrivals, expected about %v", got, tt.want)
+			}
+			// The mean gap of the phase is its duration over the arrivals
+			mean := tt.phase.Duration.Duration / time.Duration(got)
+			if want := time.Duration(float64(tt.phase.Duration.Duration) / tt.want); math.Abs(float64(mean-want)) > 0.03*float64(want) {
+				t.Errorf("mean gap is %s, expected about %s", mean, want)
+			}
+		})
+	}
+}
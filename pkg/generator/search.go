@@ -0,0 +1,334 @@
+package generator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+)
+
+// Search defaults, used when the config leaves a field empty
+const (
+	defaultSearchStartRate  = 10
+	defaultSearchStepFactor = 2
+	defaultSearchPrecision  = 0.05
+	defaultSearchStage      = 30 * time.Second
+	defaultSearchMaxStages  = 20
+	defaultSLOPercentile    = 99
+	// minSearchGap stops the bisection when the bounds are this close in requests per second
+	minSearchGap = 0.1
+)
+
+// SearchStage is the outcome of one probe stage of the throughput search
+type SearchStage struct {
+	Stage int
+	Rate  float64
+	// AchievedRate is the arrivals per second of the measured part, like Rate.
+	// Each arrival sends a request to every target the target selection picks.
+	AchievedRate float64
+	// Sent and Errors count the requests of those arrivals, Errors the ones whose outcome is not ok
+	Sent      int64
+	Errors    int64
+	ErrorRate float64
+	// TTFB is the value at the SLO percentile
+	TTFB time.Duration
+	Pass bool
+}
+
+// SearchResult is the highest rate that met the SLO and every stage that led to it
+type SearchResult struct {
+	// MaxRate is 0 if no stage met the SLO
+	MaxRate float64
+	Stages  []SearchStage
+}
+
+// WriteTable prints one row per stage
+func (r SearchResult) WriteTable(w io.Writer, slo config.SLO) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "stage\trate\tachieved\tsent\terrors\terror rate\tp%v ttfb (ms)\tslo\t\n", sloPercentile(slo))
+	for _, s := range r.Stages {
+		verdict := "fail"
+		if s.Pass {
+			verdict = "pass"
+		}
+		fmt.Fprintf(tw, "%d\t%.2f\t%.2f\t%d\t%d\t%.4f\t%.3f\t%s\t\n",
+			s.Stage, s.Rate, s.AchievedRate, s.Sent, s.Errors, s.ErrorRate, float64(s.TTFB)/float64(time.Millisecond), verdict)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "max sustainable rate: %.2f rps\n", r.MaxRate)
+	return err
+}
+
+func sloPercentile(slo config.SLO) float64 {
+	if slo.Percentile <= 0 {
+		return defaultSLOPercentile
+	}
+	return slo.Percentile
+}
+
+// stageStats counts the results of the arrivals of one measured stage
+type stageStats struct {
+	// from is when the stage started measuring, results of earlier arrivals are not counted
+	from   time.Time
+	mu     sync.Mutex
+	sent   int64
+	errors int64
+	ttfb   *hdrhistogram.Histogram
+}
+
+func newStageStats(from time.Time) *stageStats {
+	// Microseconds from 1µs to one hour, like the latency package
+	return &stageStats{from: from, ttfb: hdrhistogram.New(1, int64(time.Hour/time.Microsecond), 3)}
+}
+
+// add counts a result by its outcome, so the expect rules of the target decide what is an error
+func (s *stageStats) add(r store.Result) {
+	if r.Intended.Before(s.from) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	if r.Outcome != store.OutcomeOK {
+		s.errors++
+		return
+	}
+	s.ttfb.RecordValue(max(r.TTFB.Microseconds(), 1))
+}
+
+var _ store.Sink = &stageSink{}
+
+// stageSink passes every result on to the sink of the run and counts it
+// towards the stage that is measuring, if any. Results of the warmup that
+// arrive while a stage is measuring are left out by their intended time.
+type stageSink struct {
+	store.Sink
+	stage atomic.Pointer[stageStats]
+}
+
+func (s *stageSink) Write(r store.Result) error {
+	if stage := s.stage.Load(); stage != nil {
+		stage.add(r)
+	}
+	return s.Sink.Write(r)
+}
+
+// searcher runs the throughput search. fire sends the requests of one arrival,
+// drain waits until every request sent so far has finished.
+type searcher struct {
+	ctx      context.Context
+	logger   *slog.Logger
+	cfg      config.Search
+	arrivals arrivalProcess
+	results  *stageSink
+	report   func(phase string, rate float64)
+	fire     func(intended time.Time, phase string)
+	drain    func()
+}
+
+// run multiplies the rate by the step factor while the SLO holds, then bisects
+// between the highest passing and the lowest failing rate until they are
+// within the configured precision
+func (s *searcher) run() SearchResult {
+	rate := s.cfg.StartRate
+	if rate <= 0 {
+		rate = defaultSearchStartRate
+	}
+	factor := s.cfg.StepFactor
+	if factor <= 1 {
+		factor = defaultSearchStepFactor
+	}
+	precision := s.cfg.Precision
+	if precision <= 0 {
+		precision = defaultSearchPrecision
+	}
+	maxStages := s.cfg.MaxStages
+	if maxStages <= 0 {
+		maxStages = defaultSearchMaxStages
+	}
+
+	var result SearchResult
+	failed := 0.0 // lowest failing rate, 0 until a stage fails
+	for i := 0; i < maxStages; i++ {
+		stage := s.stage(i, rate)
+		if s.ctx.Err() != nil {
+			// An interrupted stage says nothing about the rate
+			break
+		}
+		result.Stages = append(result.Stages, stage)
+		if stage.Pass {
+			result.MaxRate = max(result.MaxRate, rate)
+		} else {
+			failed = rate
+		}
+
+		if failed == 0 {
+			if s.cfg.MaxRate > 0 && rate >= s.cfg.MaxRate {
+				s.logger.Info("Search reached the maximum rate", "maxRate", s.cfg.MaxRate)
+				break
+			}
+			rate *= factor
+			if s.cfg.MaxRate > 0 {
+				rate = min(rate, s.cfg.MaxRate)
+			}
+		} else {
+			gap := failed - result.MaxRate
+			if gap <= precision*failed || gap <= minSearchGap {
+				break
+			}
+			rate = (result.MaxRate + failed) / 2
+		}
+
+		if !s.cooldown() {
+			break
+		}
+	}
+	s.logger.Info("Search complete", "maxRate", result.MaxRate, "stages", len(result.Stages))
+	return result
+}
+
+// stage runs the warmup and the measured part of one stage at rate
+func (s *searcher) stage(i int, rate float64) SearchStage {
+	phase := fmt.Sprintf("search-%d", i)
+	s.report(phase, rate)
+	fire := func(intended time.Time) {
+		s.fire(intended, phase)
+	}
+
+	if warmup := s.cfg.Warmup.Duration; warmup > 0 {
+		s.logger.Info("Warming up search stage", "phase", phase, "rate", rate, "duration", warmup)
+		schedule(s.ctx, s.arrivals, constantRate(rate), warmup, fire)
+	}
+
+	duration := s.cfg.StageDuration.Duration
+	if duration <= 0 {
+		duration = defaultSearchStage
+	}
+	s.logger.Info("Starting search stage", "phase", phase, "rate", rate, "duration", duration)
+	start := time.Now()
+	stats := newStageStats(start)
+	s.results.stage.Store(stats)
+	arrivals := schedule(s.ctx, s.arrivals, constantRate(rate), duration, fire)
+	elapsed := time.Since(start)
+	// Late responses of this stage still count towards it
+	s.drain()
+	s.results.stage.Store(nil)
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stage := SearchStage{
+		Stage:        i,
+		Rate:         rate,
+		AchievedRate: float64(arrivals) / elapsed.Seconds(),
+		Sent:         stats.sent,
+		Errors:       stats.errors,
+		TTFB:         time.Duration(stats.ttfb.ValueAtPercentile(sloPercentile(s.cfg.SLO))) * time.Microsecond,
+	}
+	if stats.sent > 0 {
+		stage.ErrorRate = float64(stats.errors) / float64(stats.sent)
+	}
+	stage.Pass = stats.sent > 0 && stage.ErrorRate <= s.cfg.SLO.MaxErrorRate &&
+		(s.cfg.SLO.MaxTTFB.Duration <= 0 || stage.TTFB <= s.cfg.SLO.MaxTTFB.Duration)
+
+	s.logger.Info("Search stage complete",
+		"phase", phase,
+		"rate", rate,
+		"achievedRate", stage.AchievedRate,
+		"sent", stage.Sent,
+		"errors", stage.Errors,
+		"errorRate", stage.ErrorRate,
+		"percentile", sloPercentile(s.cfg.SLO),
+		"TTFB", stage.TTFB,
+		"pass", stage.Pass)
+	return stage
+}
+
+// cooldown pauses between stages, it returns false if the search was stopped
+func (s *searcher) cooldown() bool {
+	if s.cfg.Cooldown.Duration <= 0 {
+		return s.ctx.Err() == nil
+	}
+	s.report("search-cooldown", 0)
+	select {
+	case <-s.ctx.Done():
+		return false
+	case <-time.After(s.cfg.Cooldown.Duration):
+		return true
+	}
+}
+
+// StartSearch implements Generator.
+func (g *generator) StartSearch() (SearchResult, error) {
+	selector, err := newTargetSelector(g.cfg.Rate.TargetSelection, g.cfg.Targets, g.cfg.Rate.Arrival.Seed)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	g.selector = selector
+	arrivals, err := newArrivalProcess(g.cfg.Rate.Arrival)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	g.arrivals = arrivals
+
+	results := &stageSink{Sink: g.results}
+	g.results = results
+	defer func() { g.results = results.Sink }()
+
+	s := &searcher{
+		ctx:      g.ctx,
+		logger:   g.logger,
+		cfg:      g.cfg.Search,
+		arrivals: g.arrivals,
+		results:  results,
+		report:   g.set,
+		fire:     g.fireAll,
+		drain:    g.wg.Wait,
+	}
+	result := s.run()
+	g.wg.Wait()
+	return result, nil
+}
+
+// StartSearch implements Generator.
+func (c *cloudEventGenerator) StartSearch() (SearchResult, error) {
+	arrivals, err := newArrivalProcess(c.cfg.Rate.Arrival)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	c.arrivals = arrivals
+
+	results := &stageSink{Sink: c.results}
+	c.results = results
+	defer func() { c.results = results.Sink }()
+
+	target := c.cfg.Targets[0]
+	s := &searcher{
+		ctx:      c.ctx,
+		logger:   c.logger,
+		cfg:      c.cfg.Search,
+		arrivals: c.arrivals,
+		results:  results,
+		report:   c.set,
+		fire: func(intended time.Time, phase string) {
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+				c.sendRequest(target, intended, phase)
+			}()
+		},
+		drain: c.wg.Wait,
+	}
+	result := s.run()
+	c.wg.Wait()
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package generator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/luccadibe/knativeBenchmark/pkg/connection"
+)
+
+func TestSearchStageCountsOutcomes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		// expect are the statuses the second target allows
+		expect        []int
+		wantErrorRate float64
+	}{
+		// A 404 the target expects is not an error
+		{name: "expected status", expect: []int{http.StatusNotFound}, wantErrorRate: 0},
+		{name: "unexpected status", expect: []int{http.StatusOK}, wantErrorRate: 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Targets: []*config.Target{
+					{URL: server.URL + "/", Weight: 1},
+					{URL: server.URL + "/missing", Weight: 1, Expect: &config.Expect{Status: tt.expect}},
+				},
+				Search: config.Search{
+					StartRate:     20,
+					MaxStages:     1,
+					StageDuration: config.Duration{Duration: time.Second},
+					SLO:           config.SLO{MaxErrorRate: 0.1},
+				},
+			}
+			sink := &memorySink{}
+			pool := connection.NewPool("", 10, 10, time.Minute, time.Second, "")
+			gen := New(context.Background(), cfg, discard, pool, sink)
+
+			result, err := gen.StartSearch()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Stages) != 1 {
+				t.Fatalf("got %d stages", len(result.Stages))
+			}
+			stage := result.Stages[0]
+			// Every arrival goes to both targets, the achieved rate counts arrivals
+			if stage.AchievedRate < 15 || stage.AchievedRate > 21 {
+				t.Errorf("achieved %.2f rps at a rate of 20", stage.AchievedRate)
+			}
+			if stage.Sent != int64(len(sink.all())) {
+				t.Errorf("counted %d requests, %d results were written", stage.Sent, len(sink.all()))
+			}
+			if stage.ErrorRate != tt.wantErrorRate {
+				t.Errorf("error rate is %v, expected %v", stage.ErrorRate, tt.wantErrorRate)
+			}
+			if stage.Pass != (tt.wantErrorRate <= cfg.Search.SLO.MaxErrorRate) {
+				t.Errorf("stage pass is %v with error rate %v", stage.Pass, stage.ErrorRate)
+			}
+		})
+	}
+}
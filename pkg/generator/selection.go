@@ -0,0 +1,108 @@
+package generator
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+// targetSelector decides which targets receive a request on each arrival.
+// It is only called from the scheduling goroutine, so implementations need no locking.
+type targetSelector interface {
+	next() []*config.Target
+}
+
+func newTargetSelector(mode string, targets []*config.Target, seed int64) (targetSelector, error) {
+	if mode == config.SelectWeighted || mode == config.SelectSmooth {
+		total := 0
+		for _, t := range targets {
+			total += max(t.Weight, 0)
+		}
+		if total == 0 {
+			return nil, fmt.Errorf("%s target selection needs a target with a positive weight", mode)
+		}
+	}
+	switch mode {
+	case "", config.SelectAll:
+		return allTargets(targets), nil
+	case config.SelectWeighted:
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		return newWeightedSelector(targets, rand.New(rand.NewSource(seed))), nil
+	case config.SelectSmooth:
+		return newSmoothSelector(targets), nil
+	default:
+		return nil, fmt.Errorf("unknown target selection %q", mode)
+	}
+}
+
+// targetWeight is the weight of t, a target with weight 0 is never picked.
+// Config loading sets missing weights to 1.
+func targetWeight(t *config.Target) int {
+	return max(t.Weight, 0)
+}
+
+// allTargets fans every arrival out to all targets
+type allTargets []*config.Target
+
+func (a allTargets) next() []*config.Target {
+	return a
+}
+
+// weightedSelector picks one target at random with probability proportional to its weight
+type weightedSelector struct {
+	targets    []*config.Target
+	cumulative []int
+	rng        *rand.Rand
+}
+
+func newWeightedSelector(targets []*config.Target, rng *rand.Rand) *weightedSelector {
+	cumulative := make([]int, len(targets))
+	total := 0
+	for i, t := range targets {
+		total += targetWeight(t)
+		cumulative[i] = total
+	}
+	return &weightedSelector{targets: targets, cumulative: cumulative, rng: rng}
+}
+
+func (w *weightedSelector) next() []*config.Target {
+	n := w.rng.Intn(w.cumulative[len(w.cumulative)-1])
+	for i, c := range w.cumulative {
+		if n < c {
+			return w.targets[i : i+1]
+		}
+	}
+	return w.targets[len(w.targets)-1:]
+}
+
+// smoothSelector is the smooth weighted round-robin used by nginx. It hits the
+// exact mix every sum(weights) arrivals and interleaves targets instead of bursting.
+type smoothSelector struct {
+	targets []*config.Target
+	current []int
+	total   int
+}
+
+func newSmoothSelector(targets []*config.Target) *smoothSelector {
+	total := 0
+	for _, t := range targets {
+		total += targetWeight(t)
+	}
+	return &smoothSelector{targets: targets, current: make([]int, len(targets)), total: total}
+}
+
+func (s *smoothSelector) next() []*config.Target {
+	best := 0
+	for i, t := range s.targets {
+		s.current[i] += targetWeight(t)
+		if s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	s.current[best] -= s.total
+	return s.targets[best : best+1]
+}
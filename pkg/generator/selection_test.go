@@ -0,0 +1,34 @@
+package generator
+
+import (
+	"testing"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+func TestSelectorsSkipZeroWeight(t *testing.T) {
+	for _, mode := range []string{config.SelectWeighted, config.SelectSmooth} {
+		t.Run(mode, func(t *testing.T) {
+			targets := []*config.Target{
+				{URL: "http://excluded.functions.example.com", Weight: 0},
+				{URL: "http://a.functions.example.com", Weight: 3},
+				{URL: "http://b.functions.example.com", Weight: 1},
+			}
+			selector, err := newTargetSelector(mode, targets, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			picked := make(map[*config.Target]int)
+			for i := 0; i < 400; i++ {
+				picked[selector.next()[0]]++
+			}
+			if picked[targets[0]] != 0 || picked[targets[1]] == 0 || picked[targets[2]] == 0 {
+				t.Errorf("picked %d, %d and %d times", picked[targets[0]], picked[targets[1]], picked[targets[2]])
+			}
+
+			if _, err := newTargetSelector(mode, targets[:1], 1); err == nil {
+				t.Error("expected an error without a positive weight")
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package generator
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Status is what a generator is doing right now
+type Status struct {
+	Phase string `json:"phase"`
+	// TargetRate is the requests per second the generator is aiming for, 0 if it has no rate (closed loop, trace replay)
+	TargetRate float64 `json:"targetRps"`
+}
+
+// Summary counts the requests of a run. Planned requests were due, Sent ones
+// were handed to the connection pool and Completed ones returned a response or an error.
+// Planned requests that are not sent were due after the generator was stopped,
+// sent ones that are not completed were still in flight.
+type Summary struct {
+	Planned   int64 `json:"planned"`
+	Sent      int64 `json:"sent"`
+	Completed int64 `json:"completed"`
+}
+
+// progress holds the Status and the request counts of a generator. The status
+// is written by the scheduling goroutine, both can be read from anywhere.
+type progress struct {
+	mu     sync.RWMutex
+	status Status
+
+	planned   atomic.Int64
+	sent      atomic.Int64
+	completed atomic.Int64
+}
+
+func (p *progress) set(phase string, rate float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = Status{Phase: phase, TargetRate: rate}
+}
+
+// Status implements Generator.
+func (p *progress) Status() Status {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.status
+}
+
+// Summary implements Generator.
+func (p *progress) Summary() Summary {
+	return Summary{
+		Planned:   p.planned.Load(),
+		Sent:      p.sent.Load(),
+		Completed: p.completed.Load(),
+	}
+}
@@ -0,0 +1,400 @@
+package generator
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/luccadibe/knativeBenchmark/pkg/connection"
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+)
+
+const phaseTrace = "trace"
+
+var _ Generator = &traceGenerator{}
+
+// traceGenerator replays a recorded invocation trace against the targets.
+// It reuses the HTTP request path of generator.
+type traceGenerator struct {
+	*generator
+}
+
+func NewTraceGenerator(ctx context.Context, cfg *config.Config, logger *slog.Logger, pool connection.Pool, results store.Sink) Generator {
+	return &traceGenerator{
+		generator: New(ctx, cfg, logger, pool, results).(*generator),
+	}
+}
+
+// Start implements Generator.
+func (t *traceGenerator) Start() error {
+	err := t.replay()
+	t.wg.Wait()
+	return err
+}
+
+// StartColdStart implements Generator.
+func (t *traceGenerator) StartColdStart() error {
+	return fmt.Errorf("cold start mode is not supported when replaying a trace")
+}
+
+// StartSearch implements Generator.
+func (t *traceGenerator) StartSearch() (SearchResult, error) {
+	return SearchResult{}, fmt.Errorf("search mode is not supported when replaying a trace")
+}
+
+// traceEvent is a single invocation, offset is relative to the start of the replayed window
+type traceEvent struct {
+	offset time.Duration
+	target *config.Target
+}
+
+// traceIterator returns the invocations in order, ok is false once the trace is exhausted
+type traceIterator func() (event traceEvent, ok bool)
+
+func (t *traceGenerator) replay() error {
+	tr := t.cfg.Trace
+	if tr == nil {
+		return fmt.Errorf("no trace configured")
+	}
+	speedup := tr.Speedup
+	if speedup <= 0 {
+		speedup = 1
+	}
+
+	var next traceIterator
+	var err error
+	switch tr.Format {
+	case "", config.TraceAzure:
+		next, err = loadAzureTrace(tr, t.cfg.Targets, t.logger)
+	case config.TraceJSONL:
+		next, err = loadJSONLTrace(tr, t.cfg.Targets, t.logger)
+	default:
+		err = fmt.Errorf("unknown trace format %q", tr.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("loading trace: %w", err)
+	}
+
+	t.logger.Info("Starting trace replay", "path", tr.Path, "format", tr.Format, "speedup", speedup)
+	t.set(phaseTrace, 0)
+
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	requestCount := 0
+	for {
+		event, ok := next()
+		if !ok {
+			break
+		}
+		intended := start.Add(time.Duration(float64(event.offset) / speedup))
+		timer.Reset(time.Until(intended))
+		select {
+		case <-t.ctx.Done():
+			t.logger.Info("Generator stopped", "totalRequests", requestCount)
+			return nil
+		case <-timer.C:
+		}
+
+		t.wg.Add(1)
+		go func(target *config.Target) {
+			defer t.wg.Done()
+			if _, err := t.sendRequest(target, intended, phaseTrace); err != nil && t.ctx.Err() == nil {
+				t.logger.Error("Request failed", "error", err)
+			}
+		}(event.target)
+		requestCount++
+	}
+
+	t.logger.Info("Trace replay complete", "totalRequests", requestCount, "elapsed", time.Since(start))
+	t.Stop()
+	return nil
+}
+
+// mapTraceFunctions returns the target for every replayed function ID.
+// Targets with an explicit traceFunction are used as is, otherwise the busiest
+// functions from totals are assigned to the targets in order.
+func mapTraceFunctions(targets []*config.Target, totals map[string]int, logger *slog.Logger) (map[string]*config.Target, error) {
+	mapping := make(map[string]*config.Target)
+	for _, target := range targets {
+		if target.TraceFunction != "" {
+			mapping[target.TraceFunction] = target
+		}
+	}
+
+	if len(mapping) == 0 {
+		ids := make([]string, 0, len(totals))
+		for id := range totals {
+			ids = append(ids, id)
+		}
+		// Sort by invocations, ties by ID so the mapping is stable between runs
+		sort.Slice(ids, func(i, j int) bool {
+			if totals[ids[i]] != totals[ids[j]] {
+				return totals[ids[i]] > totals[ids[j]]
+			}
+			return ids[i] < ids[j]
+		})
+		for i, target := range targets {
+			if i >= len(ids) {
+				break
+			}
+			mapping[ids[i]] = target
+		}
+	}
+
+	if len(mapping) == 0 {
+		return nil, fmt.Errorf("no trace functions could be mapped onto targets")
+	}
+	for id, target := range mapping {
+		logger.Info("Mapped trace function", "function", id, "target", target.URL, "invocations", totals[id])
+	}
+	return mapping, nil
+}
+
+// loadAzureTrace reads a per-minute invocation count CSV and spreads the counts
+// inside each minute. A function can have one row per trigger, so the file is read
+// twice: once to total the rows of every function for the mapping, then to keep
+// only the rows of mapped functions in memory.
+func loadAzureTrace(tr *config.Trace, targets []*config.Target, logger *slog.Logger) (traceIterator, error) {
+	explicit := false
+	for _, target := range targets {
+		explicit = explicit || target.TraceFunction != ""
+	}
+
+	// With an explicit mapping only its functions are totalled
+	totals := make(map[string]int)
+	if _, err := readAzureTrace(tr, func(id string, row []int) {
+		if explicit && !isTraceFunction(targets, id) {
+			return
+		}
+		for _, n := range row {
+			totals[id] += n
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if err := findTraceFunctions(targets, totals); err != nil {
+		return nil, err
+	}
+	mapping, err := mapTraceFunctions(targets, totals, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string][]int)
+	minutes, err := readAzureTrace(tr, func(id string, row []int) {
+		if _, ok := mapping[id]; !ok {
+			return
+		}
+		// Functions can appear once per trigger, merge them
+		if existing, ok := counts[id]; ok {
+			for i := range existing {
+				existing[i] += row[i]
+			}
+		} else {
+			counts[id] = row
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seed := tr.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	// Expand one minute at a time so long traces do not need all events in memory
+	minute := 0
+	var pending []traceEvent
+	return func() (traceEvent, bool) {
+		for len(pending) == 0 {
+			if minute >= minutes {
+				return traceEvent{}, false
+			}
+			minuteStart := time.Duration(minute) * time.Minute
+			for id, target := range mapping {
+				n := counts[id][minute]
+				for i := 0; i < n; i++ {
+					var within time.Duration
+					if tr.Spread == config.SpreadEven {
+						within = time.Duration(i) * time.Minute / time.Duration(n)
+					} else {
+						within = time.Duration(rng.Int63n(int64(time.Minute)))
+					}
+					pending = append(pending, traceEvent{offset: minuteStart + within, target: target})
+				}
+			}
+			sort.Slice(pending, func(i, j int) bool { return pending[i].offset < pending[j].offset })
+			minute++
+		}
+		event := pending[0]
+		pending = pending[1:]
+		return event, true
+	}, nil
+}
+
+// readAzureTrace calls fn with the function ID and the counts of the replayed
+// minutes of every row, and returns the number of replayed minutes
+func readAzureTrace(tr *config.Trace, fn func(id string, row []int)) (int, error) {
+	file, err := os.Open(tr.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(bufio.NewReader(file))
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("reading header: %w", err)
+	}
+
+	functionColumn := slices.Index(header, "HashFunction")
+	if functionColumn < 0 {
+		return 0, fmt.Errorf("missing HashFunction column")
+	}
+	// Minute columns are the ones named by their (1-based) minute number
+	var minuteColumns []int
+	for i, name := range header {
+		if _, err := strconv.Atoi(name); err == nil {
+			minuteColumns = append(minuteColumns, i)
+		}
+	}
+	if tr.StartMinute >= len(minuteColumns) {
+		return 0, fmt.Errorf("start minute %d is past the end of the trace (%d minutes)", tr.StartMinute, len(minuteColumns))
+	}
+	minuteColumns = minuteColumns[tr.StartMinute:]
+	if tr.Minutes > 0 && tr.Minutes < len(minuteColumns) {
+		minuteColumns = minuteColumns[:tr.Minutes]
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return len(minuteColumns), nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("reading trace: %w", err)
+		}
+		id := record[functionColumn]
+		row := make([]int, len(minuteColumns))
+		for i, column := range minuteColumns {
+			n, err := strconv.Atoi(record[column])
+			if err != nil {
+				return 0, fmt.Errorf("function %s minute %s: %w", id, header[column], err)
+			}
+			row[i] = n
+		}
+		fn(id, row)
+	}
+}
+
+// findTraceFunctions checks that the trace has the explicit traceFunction of
+// every target, a target without invocations would not be sent anything
+func findTraceFunctions(targets []*config.Target, totals map[string]int) error {
+	for _, target := range targets {
+		if _, ok := totals[target.TraceFunction]; target.TraceFunction != "" && !ok {
+			return fmt.Errorf("trace function %s not found in trace", target.TraceFunction)
+		}
+	}
+	return nil
+}
+
+func isTraceFunction(targets []*config.Target, id string) bool {
+	for _, target := range targets {
+		if target.TraceFunction == id {
+			return true
+		}
+	}
+	return false
+}
+
+type jsonlTraceRecord struct {
+	Function string `json:"function"`
+	// Timestamp in seconds, only the differences between records matter
+	Timestamp float64 `json:"timestamp"`
+}
+
+// loadJSONLTrace reads one invocation per line. Offsets are relative to the
+// earliest timestamp in the file.
+func loadJSONLTrace(tr *config.Trace, targets []*config.Target, logger *slog.Logger) (traceIterator, error) {
+	file, err := os.Open(tr.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []jsonlTraceRecord
+	totals := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record jsonlTraceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, record)
+		totals[record.Function]++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("empty trace")
+	}
+	if err := findTraceFunctions(targets, totals); err != nil {
+		return nil, err
+	}
+
+	mapping, err := mapTraceFunctions(targets, totals, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Timestamp < records[j].Timestamp })
+	origin := records[0].Timestamp
+	windowStart := time.Duration(tr.StartMinute) * time.Minute
+	windowEnd := time.Duration(-1)
+	if tr.Minutes > 0 {
+		windowEnd = windowStart + time.Duration(tr.Minutes)*time.Minute
+	}
+
+	var events []traceEvent
+	for _, record := range records {
+		target, ok := mapping[record.Function]
+		if !ok {
+			continue
+		}
+		offset := time.Duration((record.Timestamp - origin) * float64(time.Second))
+		if offset < windowStart || (windowEnd >= 0 && offset >= windowEnd) {
+			continue
+		}
+		events = append(events, traceEvent{offset: offset - windowStart, target: target})
+	}
+
+	i := 0
+	return func() (traceEvent, bool) {
+		if i >= len(events) {
+			return traceEvent{}, false
+		}
+		i++
+		return events[i-1], true
+	}, nil
+}
@@ -0,0 +1,87 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+func TestAzureTraceMergesTriggersBeforeMapping(t *testing.T) {
+	// split has the most invocations, but over two rows with fewer than single
+	trace := "HashOwner,HashApp,HashFunction,Trigger,1,2\n" +
+		"o,a,split,http,3,2\n" +
+		"o,a,single,http,4,4\n" +
+		"o,a,f1,http,1,0\n" +
+		"o,a,f2,http,1,0\n" +
+		"o,a,f3,http,1,0\n" +
+		"o,a,f4,http,1,0\n" +
+		"o,a,f5,http,1,0\n" +
+		"o,a,split,timer,0,5\n"
+	path := filepath.Join(t.TempDir(), "trace.csv")
+	if err := os.WriteFile(path, []byte(trace), 0666); err != nil {
+		t.Fatal(err)
+	}
+	target := &config.Target{URL: "http://hello.functions.example.com", Weight: 1}
+	tr := &config.Trace{Path: path, Format: config.TraceAzure, Spread: config.SpreadEven}
+
+	next, err := loadAzureTrace(tr, []*config.Target{target}, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []time.Duration
+	for event, ok := next(); ok; event, ok = next() {
+		if event.target != target {
+			t.Fatalf("event for %v", event.target)
+		}
+		offsets = append(offsets, event.offset)
+	}
+
+	// Even spread places the 3 invocations of the first minute and the 7 of the second at equal gaps
+	var want []time.Duration
+	for i := 0; i < 3; i++ {
+		want = append(want, time.Duration(i)*time.Minute/3)
+	}
+	for i := 0; i < 7; i++ {
+		want = append(want, time.Minute+time.Duration(i)*time.Minute/7)
+	}
+	if len(offsets) != len(want) {
+		t.Fatalf("got %d events, expected the %d of split", len(offsets), len(want))
+	}
+	for i := range want {
+		if offsets[i] != want[i] {
+			t.Errorf("event %d at %s, expected %s", i, offsets[i], want[i])
+		}
+	}
+}
+
+func TestTraceFunctionNotFound(t *testing.T) {
+	traces := map[string]string{
+		config.TraceAzure: "HashOwner,HashApp,HashFunction,Trigger,1\no,a,present,http,3\n",
+		config.TraceJSONL: "{\"function\": \"present\", \"timestamp\": 0}\n{\"function\": \"present\", \"timestamp\": 1.5}\n",
+	}
+	for format, trace := range traces {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trace")
+			if err := os.WriteFile(path, []byte(trace), 0666); err != nil {
+				t.Fatal(err)
+			}
+			targets := []*config.Target{
+				{URL: "http://present.functions.example.com", Weight: 1, TraceFunction: "present"},
+				{URL: "http://absent.functions.example.com", Weight: 1, TraceFunction: "absent"},
+			}
+			tr := &config.Trace{Path: path, Format: format}
+			load := loadAzureTrace
+			if format == config.TraceJSONL {
+				load = loadJSONLTrace
+			}
+			_, err := load(tr, targets, discard)
+			if err == nil || !strings.Contains(err.Error(), "absent") {
+				t.Fatalf("expected an error about the absent function, got %v", err)
+			}
+		})
+	}
+}
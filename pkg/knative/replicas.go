@@ -0,0 +1,101 @@
+package knative
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+// Replicas reports how many ready pods serve a Knative Service
+type Replicas interface {
+	Ready(ctx context.Context, namespace, service string) (int, error)
+}
+
+var _ Replicas = &revisionReplicas{}
+
+// revisionReplicas reads the actual replicas of the Service's latest ready Revision
+type revisionReplicas struct {
+	client client.Client
+}
+
+// NewReplicas reads replicas through c, which needs the serving types in its scheme
+func NewReplicas(c client.Client) Replicas {
+	return &revisionReplicas{client: c}
+}
+
+// NewClusterReplicas connects with the in-cluster config, or the kubeconfig outside a cluster
+func NewClusterReplicas() (Replicas, error) {
+	cfg, err := clientconfig.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.New(cfg, client.Options{Scheme: Scheme()})
+	if err != nil {
+		return nil, err
+	}
+	return NewReplicas(c), nil
+}
+
+// Scheme holds the Knative serving types
+func Scheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	servingv1.AddToScheme(scheme)
+	return scheme
+}
+
+func (r *revisionReplicas) Ready(ctx context.Context, namespace, service string) (int, error) {
+	svc := &servingv1.Service{}
+	if err := r.client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: service}, svc); err != nil {
+		return 0, err
+	}
+	name := svc.Status.LatestReadyRevisionName
+	if name == "" {
+		return 0, fmt.Errorf("service %s/%s has no ready revision", namespace, service)
+	}
+
+	revision := &servingv1.Revision{}
+	if err := r.client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, revision); err != nil {
+		return 0, err
+	}
+	if revision.Status.ActualReplicas == nil {
+		return 0, nil
+	}
+	return int(*revision.Status.ActualReplicas), nil
+}
+
+// ServiceOf returns the namespace and name of the Knative Service behind target.
+// Unless the target sets them, they are the first two labels of its host.
+func ServiceOf(target *config.Target) (namespace, service string, err error) {
+	if target.Service != "" && target.Namespace != "" {
+		return target.Namespace, target.Service, nil
+	}
+	// In dev mode the URL points at localhost and the host is kept as the Host header
+	raw := target.URL
+	if target.HostHeader != "" {
+		raw = target.HostHeader
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", err
+	}
+	labels := strings.Split(u.Hostname(), ".")
+	if len(labels) < 2 {
+		return "", "", fmt.Errorf("cannot tell the Knative Service of %s, set service and namespace on the target", raw)
+	}
+	namespace, service = labels[1], labels[0]
+	if target.Namespace != "" {
+		namespace = target.Namespace
+	}
+	if target.Service != "" {
+		service = target.Service
+	}
+	return namespace, service, nil
+}
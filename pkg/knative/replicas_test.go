@@ -0,0 +1,127 @@
+package knative
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+)
+
+func service(name, latestReady string) *servingv1.Service {
+	svc := &servingv1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "functions", Name: name}}
+	svc.Status.LatestReadyRevisionName = latestReady
+	return svc
+}
+
+func revision(name string, replicas *int32) *servingv1.Revision {
+	rev := &servingv1.Revision{ObjectMeta: metav1.ObjectMeta{Namespace: "functions", Name: name}}
+	rev.Status.ActualReplicas = replicas
+	return rev
+}
+
+func TestReady(t *testing.T) {
+	three := int32(3)
+	c := fake.NewClientBuilder().WithScheme(Scheme()).WithObjects(
+		service("hello", "hello-00002"),
+		// The older revision still has pods, only the latest ready one counts
+		revision("hello-00001", &three),
+		revision("hello-00002", &three),
+		service("idle", "idle-00001"),
+		revision("idle-00001", nil),
+		service("new", ""),
+		service("orphan", "orphan-00001"),
+	).WithStatusSubresource(&servingv1.Service{}, &servingv1.Revision{}).Build()
+	replicas := NewReplicas(c)
+
+	tests := []struct {
+		service string
+		want    int
+		wantErr bool
+	}{
+		{service: "hello", want: 3},
+		{service: "idle", want: 0},
+		{service: "new", wantErr: true},
+		{service: "orphan", wantErr: true},
+		{service: "missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			got, err := replicas.Ready(context.Background(), "functions", tt.service)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d pods", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d pods, expected %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadyFollowsScaleDown(t *testing.T) {
+	two := int32(2)
+	c := fake.NewClientBuilder().WithScheme(Scheme()).WithObjects(
+		service("hello", "hello-00001"),
+		revision("hello-00001", &two),
+	).WithStatusSubresource(&servingv1.Revision{}).Build()
+	replicas := NewReplicas(c)
+	ctx := context.Background()
+
+	if got, err := replicas.Ready(ctx, "functions", "hello"); err != nil || got != 2 {
+		t.Fatalf("got %d pods and %v, expected 2", got, err)
+	}
+	rev := &servingv1.Revision{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "functions", Name: "hello-00001"}, rev); err != nil {
+		t.Fatal(err)
+	}
+	zero := int32(0)
+	rev.Status.ActualReplicas = &zero
+	if err := c.Status().Update(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := replicas.Ready(ctx, "functions", "hello"); err != nil || got != 0 {
+		t.Fatalf("got %d pods and %v after the scale down, expected 0", got, err)
+	}
+}
+
+func TestServiceOf(t *testing.T) {
+	tests := []struct {
+		name                    string
+		target                  config.Target
+		wantNamespace, wantName string
+		wantErr                 bool
+	}{
+		{name: "from the host", target: config.Target{URL: "http://hello.functions.svc.cluster.local"}, wantNamespace: "functions", wantName: "hello"},
+		{name: "dev mode uses the host header", target: config.Target{URL: "http://localhost:8080", HostHeader: "http://hello.functions.example.com"}, wantNamespace: "functions", wantName: "hello"},
+		{name: "set on the target", target: config.Target{URL: "http://localhost:8080", Service: "hello", Namespace: "functions"}, wantNamespace: "functions", wantName: "hello"},
+		{name: "namespace overridden", target: config.Target{URL: "http://hello.default.example.com", Namespace: "functions"}, wantNamespace: "functions", wantName: "hello"},
+		{name: "single label host", target: config.Target{URL: "http://localhost:8080"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace, name, err := ServiceOf(&tt.target)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s/%s", namespace, name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if namespace != tt.wantNamespace || name != tt.wantName {
+				t.Errorf("got %s/%s, expected %s/%s", namespace, name, tt.wantNamespace, tt.wantName)
+			}
+		})
+	}
+}
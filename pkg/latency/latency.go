@@ -0,0 +1,255 @@
+package latency
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// Metrics recorded for every target. The corrected ones are measured from the
+// intended send time instead of the actual one, so requests that were sent late
+// because the generator fell behind still count their waiting time
+// (coordinated omission correction).
+const (
+	TTFB           = "ttfb"
+	Total          = "total"
+	TTFBCorrected  = "ttfb_corrected"
+	TotalCorrected = "total_corrected"
+)
+
+var metrics = []string{TTFB, Total, TTFBCorrected, TotalCorrected}
+
+// Failed returns the metric of the requests that got no whole response and
+// ended with outcome, e.g. failed_timeout. It holds the time until they failed.
+func Failed(outcome string) string {
+	return "failed_" + outcome
+}
+
+// Percentiles printed in the tables
+var Percentiles = []float64{50, 75, 90, 95, 99, 99.9, 99.99}
+
+// Values are recorded in microseconds, from 1µs up to one hour
+const (
+	lowestValue  = 1
+	highestValue = int64(time.Hour / time.Microsecond)
+	sigFigs      = 3
+)
+
+// tagSeparator separates the metric and the target in histogram tags
+const tagSeparator = "|"
+
+// Recorder keeps one histogram per target and metric, and one per target and
+// outcome of failed requests. It is safe for concurrent use.
+type Recorder struct {
+	mu         sync.Mutex
+	histograms map[string]*hdrhistogram.Histogram
+	start      time.Time
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		histograms: make(map[string]*hdrhistogram.Histogram),
+		start:      time.Now(),
+	}
+}
+
+// Record adds one response. intended is when the request should have been sent, sent when it actually was.
+func (r *Recorder) Record(target string, intended, sent time.Time, ttfb, total time.Duration) {
+	lag := sent.Sub(intended)
+	if lag < 0 {
+		lag = 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(target, TTFB, ttfb)
+	r.record(target, Total, total)
+	r.record(target, TTFBCorrected, lag+ttfb)
+	r.record(target, TotalCorrected, lag+total)
+}
+
+// RecordFailure adds one request that got no whole response, by its outcome and the time until it failed
+func (r *Recorder) RecordFailure(target, outcome string, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(target, Failed(outcome), elapsed)
+}
+
+func (r *Recorder) record(target, metric string, d time.Duration) {
+	key := metric + tagSeparator + target
+	h, ok := r.histograms[key]
+	if !ok {
+		h = newHistogram()
+		h.SetTag(key)
+		r.histograms[key] = h
+	}
+	// Values outside the trackable range are clamped instead of dropped
+	v := min(max(d.Microseconds(), lowestValue), highestValue)
+	h.RecordValue(v)
+}
+
+func newHistogram() *hdrhistogram.Histogram {
+	return hdrhistogram.New(lowestValue, highestValue, sigFigs)
+}
+
+// Set is a collection of histograms keyed by metric and target, as read back from a file
+type Set map[string]*hdrhistogram.Histogram
+
+// Snapshot copies the current histograms
+func (r *Recorder) Snapshot() Set {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	set := make(Set, len(r.histograms))
+	for key, h := range r.histograms {
+		set[key] = hdrhistogram.Import(h.Export())
+		set[key].SetTag(key)
+	}
+	return set
+}
+
+// WriteFile stores the current histograms, see Set.WriteFile
+func (r *Recorder) WriteFile(path string) error {
+	return r.Snapshot().WriteFile(path, r.start)
+}
+
+// WriteFile stores the histograms in the HdrHistogram interval log format,
+// one tagged histogram per target and metric
+func (s Set) WriteFile(path string, start time.Time) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := hdrhistogram.NewHistogramLogWriter(file)
+	if err := writer.OutputLogFormatVersion(); err != nil {
+		return err
+	}
+	if err := writer.OutputStartTime(start.UnixMilli()); err != nil {
+		return err
+	}
+	if err := writer.OutputLegend(); err != nil {
+		return err
+	}
+	for _, key := range s.keys() {
+		if err := writer.OutputIntervalHistogram(s[key]); err != nil {
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// ReadFile reads the histograms written by WriteFile
+func ReadFile(path string) (Set, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	set := make(Set)
+	reader := hdrhistogram.NewHistogramLogReader(file)
+	for {
+		h, err := reader.NextIntervalHistogram()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		if h == nil {
+			return set, nil
+		}
+		set.Merge(Set{h.Tag(): h})
+	}
+}
+
+// Merge adds every histogram of other into s
+func (s Set) Merge(other Set) {
+	for key, h := range other {
+		existing, ok := s[key]
+		if !ok {
+			existing = newHistogram()
+			existing.SetTag(key)
+			s[key] = existing
+		}
+		existing.Merge(h)
+	}
+}
+
+// Entry is one histogram of the set
+type Entry struct {
+	Target    string
+	Metric    string
+	Histogram *hdrhistogram.Histogram
+}
+
+// Entries returns the histograms sorted by target and metric
+func (s Set) Entries() []Entry {
+	var entries []Entry
+	for _, key := range s.keys() {
+		metric, target, _ := strings.Cut(key, tagSeparator)
+		entries = append(entries, Entry{Target: target, Metric: metric, Histogram: s[key]})
+	}
+	return entries
+}
+
+func (s Set) keys() []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		mi, ti, _ := strings.Cut(keys[i], tagSeparator)
+		mj, tj, _ := strings.Cut(keys[j], tagSeparator)
+		if ti != tj {
+			return ti < tj
+		}
+		if oi, oj := metricOrder(mi), metricOrder(mj); oi != oj {
+			return oi < oj
+		}
+		return mi < mj
+	})
+	return keys
+}
+
+func metricOrder(metric string) int {
+	for i, m := range metrics {
+		if m == metric {
+			return i
+		}
+	}
+	return len(metrics)
+}
+
+// ValueAt returns the value at the percentile as a duration
+func (e Entry) ValueAt(percentile float64) time.Duration {
+	return time.Duration(e.Histogram.ValueAtPercentile(percentile)) * time.Microsecond
+}
+
+// WriteTable prints one row per target and metric with the percentiles in milliseconds
+func (s Set) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "target\tmetric\tcount\t")
+	for _, p := range Percentiles {
+		fmt.Fprintf(tw, "p%v\t", p)
+	}
+	fmt.Fprintln(tw, "max\t")
+
+	for _, e := range s.Entries() {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t", e.Target, e.Metric, e.Histogram.TotalCount())
+		for _, p := range Percentiles {
+			fmt.Fprintf(tw, "%.3f\t", milliseconds(e.ValueAt(p)))
+		}
+		fmt.Fprintf(tw, "%.3f\t\n", milliseconds(time.Duration(e.Histogram.Max())*time.Microsecond))
+	}
+	return tw.Flush()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,288 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/config"
+	"github.com/luccadibe/knativeBenchmark/pkg/connection"
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+)
+
+// windowSeconds is the window the achieved rate and error rate in /status are computed over
+const windowSeconds = 10
+
+// StatusFunc reports the phase the generator is in and the rate it is aiming for
+type StatusFunc func() (phase string, targetRate float64)
+
+// Monitor exposes live metrics of a running generator: Prometheus metrics on
+// /metrics and a JSON summary on /status.
+type Monitor struct {
+	registry  *prometheus.Registry
+	sent      *prometheus.CounterVec
+	inFlight  *prometheus.GaugeVec
+	responses *prometheus.CounterVec
+	errors    *prometheus.CounterVec
+	ttfb      *prometheus.HistogramVec
+	total     *prometheus.HistogramVec
+
+	mu      sync.Mutex
+	source  StatusFunc
+	start   time.Time
+	window  [windowSeconds + 1]second
+	totals  second
+	running int64
+}
+
+// second holds the counts of one wall clock second
+type second struct {
+	unix      int64
+	sent      int64
+	completed int64
+	errors    int64
+}
+
+func New() *Monitor {
+	buckets := prometheus.ExponentialBuckets(0.001, 2, 16) // 1ms to ~33s
+	m := &Monitor{
+		registry: prometheus.NewRegistry(),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "workload_generator_requests_sent_total",
+			Help: "Requests sent per target.",
+		}, []string{"target"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "workload_generator_requests_in_flight",
+			Help: "Requests waiting for a response per target.",
+		}, []string{"target"}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "workload_generator_responses_total",
+			Help: "Responses per target and HTTP status code.",
+		}, []string{"target", "code"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "workload_generator_request_errors_total",
+			Help: "Requests that failed without a response per target.",
+		}, []string{"target"}),
+		ttfb: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "workload_generator_ttfb_seconds",
+			Help:    "Time to first byte per target.",
+			Buckets: buckets,
+		}, []string{"target"}),
+		total: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "workload_generator_total_seconds",
+			Help:    "Total request time per target.",
+			Buckets: buckets,
+		}, []string{"target"}),
+		start: time.Now(),
+	}
+	m.registry.MustRegister(m.sent, m.inFlight, m.responses, m.errors, m.ttfb, m.total)
+	return m
+}
+
+// SetSource sets where /status gets the current phase and target rate from
+func (m *Monitor) SetSource(source StatusFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.source = source
+}
+
+// requestStarted counts a request that was just sent
+func (m *Monitor) requestStarted(target string) {
+	m.sent.WithLabelValues(target).Inc()
+	m.inFlight.WithLabelValues(target).Inc()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.current().sent++
+	m.totals.sent++
+	m.running++
+}
+
+// requestDone counts a finished request, metrics is nil if it failed without a response.
+// Whether the request was an error for /status is only known from its result, see resultWritten.
+func (m *Monitor) requestDone(target string, metrics *connection.ResponseMetrics, err error) {
+	m.inFlight.WithLabelValues(target).Dec()
+	if err != nil || metrics == nil {
+		m.errors.WithLabelValues(target).Inc()
+	} else {
+		m.responses.WithLabelValues(target, strconv.Itoa(metrics.Response.StatusCode)).Inc()
+		m.ttfb.WithLabelValues(target).Observe(metrics.TTFB.Seconds())
+		m.total.WithLabelValues(target).Observe(metrics.Total.Seconds())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running--
+}
+
+// resultWritten counts the result of a request, an error is any outcome but ok
+// as in the search stages. Skipped probes were never sent and are left out.
+func (m *Monitor) resultWritten(r store.Result) {
+	if r.Outcome == store.OutcomeSkipped {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.current()
+	s.completed++
+	m.totals.completed++
+	if r.Outcome != store.OutcomeOK {
+		s.errors++
+		m.totals.errors++
+	}
+}
+
+// current returns the bucket of the current second, m.mu must be held
+func (m *Monitor) current() *second {
+	now := time.Now().Unix()
+	s := &m.window[now%int64(len(m.window))]
+	if s.unix != now {
+		*s = second{unix: now}
+	}
+	return s
+}
+
+// StatusReport is the body of /status
+type StatusReport struct {
+	Phase       string  `json:"phase"`
+	TargetRPS   float64 `json:"targetRps"`
+	AchievedRPS float64 `json:"achievedRps"`
+	ErrorRate   float64 `json:"errorRate"`
+	InFlight    int64   `json:"inFlight"`
+	Sent        int64   `json:"sent"`
+	Completed   int64   `json:"completed"`
+	Errors      int64   `json:"errors"`
+	Uptime      string  `json:"uptime"`
+}
+
+// Report summarizes the last windowSeconds complete seconds
+func (m *Monitor) Report() StatusReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().Unix()
+	var sent, completed, errs int64
+	for _, s := range m.window {
+		if s.unix < now && s.unix >= now-windowSeconds {
+			sent += s.sent
+			completed += s.completed
+			errs += s.errors
+		}
+	}
+
+	report := StatusReport{
+		AchievedRPS: float64(sent) / windowSeconds,
+		InFlight:    m.running,
+		Sent:        m.totals.sent,
+		Completed:   m.totals.completed,
+		Errors:      m.totals.errors,
+		Uptime:      time.Since(m.start).Round(time.Second).String(),
+	}
+	if completed > 0 {
+		report.ErrorRate = float64(errs) / float64(completed)
+	}
+	if m.source != nil {
+		report.Phase, report.TargetRPS = m.source()
+	}
+	return report
+}
+
+// Handler serves /metrics and /status
+func (m *Monitor) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.Report())
+	})
+	return mux
+}
+
+// Serve listens on addr until ctx is done
+func (m *Monitor) Serve(ctx context.Context, addr string, logger *slog.Logger) {
+	server := &http.Server{Addr: addr, Handler: m.Handler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Info("Serving live metrics", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Metrics server failed", "error", err)
+	}
+}
+
+var _ connection.Pool = &instrumentedPool{}
+
+// instrumentedPool records every request of the wrapped pool in the monitor
+type instrumentedPool struct {
+	connection.Pool
+	monitor *Monitor
+}
+
+// WrapPool returns a pool that reports every request to m
+func (m *Monitor) WrapPool(pool connection.Pool) connection.Pool {
+	return &instrumentedPool{Pool: pool, monitor: m}
+}
+
+func (p *instrumentedPool) Get(target *config.Target) (*connection.ResponseMetrics, error) {
+	p.monitor.requestStarted(target.URL)
+	metrics, err := p.Pool.Get(target)
+	p.monitor.requestDone(target.URL, metrics, err)
+	return metrics, err
+}
+
+func (p *instrumentedPool) Post(target *config.Target, body io.Reader) (*connection.ResponseMetrics, error) {
+	p.monitor.requestStarted(target.URL)
+	metrics, err := p.Pool.Post(target, body)
+	p.monitor.requestDone(target.URL, metrics, err)
+	return metrics, err
+}
+
+func (p *instrumentedPool) Send(target *config.Target) (*connection.ResponseMetrics, error) {
+	p.monitor.requestStarted(target.URL)
+	metrics, err := p.Pool.Send(target)
+	p.monitor.requestDone(target.URL, metrics, err)
+	return metrics, err
+}
+
+func (p *instrumentedPool) Invoke(target *config.Target) (*connection.ResponseMetrics, error) {
+	p.monitor.requestStarted(target.URL)
+	metrics, err := p.Pool.Invoke(target)
+	p.monitor.requestDone(target.URL, metrics, err)
+	return metrics, err
+}
+
+func (p *instrumentedPool) GenerateCloudEvent(target *config.Target, event *cloudevents.Event) (*connection.ResponseMetrics, error) {
+	p.monitor.requestStarted(target.URL)
+	metrics, err := p.Pool.GenerateCloudEvent(target, event)
+	p.monitor.requestDone(target.URL, metrics, err)
+	return metrics, err
+}
+
+var _ store.Sink = &instrumentedSink{}
+
+// instrumentedSink counts every result written to the wrapped sink in the monitor
+type instrumentedSink struct {
+	store.Sink
+	monitor *Monitor
+}
+
+// WrapSink returns a sink that reports every result to m, the error rate in /status comes from it
+func (m *Monitor) WrapSink(sink store.Sink) store.Sink {
+	return &instrumentedSink{Sink: sink, monitor: m}
+}
+
+func (s *instrumentedSink) Write(result store.Result) error {
+	s.monitor.resultWritten(result)
+	return s.Sink.Write(result)
+}
@@ -0,0 +1,37 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/luccadibe/knativeBenchmark/pkg/store"
+)
+
+// nopSink drops every result
+type nopSink struct{}
+
+func (nopSink) Write(store.Result) error { return nil }
+func (nopSink) Close() error             { return nil }
+
+func TestStatusCountsErrorsByOutcome(t *testing.T) {
+	m := New()
+	sink := m.WrapSink(nopSink{})
+	for _, outcome := range []string{
+		store.OutcomeOK,
+		store.OutcomeOK,
+		// A 200 with the wrong body and an unexpected 404 had a response, but are errors
+		store.OutcomeAssertionFailed,
+		store.OutcomeHTTPError,
+		store.OutcomeTimeout,
+		// A skipped probe was never sent
+		store.OutcomeSkipped,
+	} {
+		if err := sink.Write(store.Result{Target: "http://hello.functions.example.com", Outcome: outcome}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := m.Report()
+	if report.Completed != 5 || report.Errors != 3 {
+		t.Errorf("counted %d completed and %d errors, expected 5 and 3", report.Completed, report.Errors)
+	}
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuffer is the number of results Buffered holds when Store.Buffer is not set
+const DefaultBuffer = 10_000
+
+// Buffered hands results to a sink from a single goroutine, so a slow disk
+// never blocks the request goroutines. Results that arrive while the buffer is
+// full are dropped and counted.
+type Buffered struct {
+	sink    Sink
+	results chan Result
+	done    chan struct{}
+	dropped atomic.Int64
+
+	// mu guards closing results against concurrent writes
+	mu     sync.RWMutex
+	closed bool
+
+	// err is the first error of the sink, reported once by Write and again by Close
+	errOnce  sync.Once
+	err      error
+	failed   atomic.Bool
+	reported atomic.Bool
+}
+
+// NewBuffered starts writing to sink through a buffer of size results
+func NewBuffered(sink Sink, size int) *Buffered {
+	if size <= 0 {
+		size = DefaultBuffer
+	}
+	b := &Buffered{
+		sink:    sink,
+		results: make(chan Result, size),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *Buffered) run() {
+	defer close(b.done)
+	for result := range b.results {
+		if err := b.sink.Write(result); err != nil {
+			b.errOnce.Do(func() {
+				b.err = err
+				b.failed.Store(true)
+			})
+		}
+	}
+}
+
+// Write queues result without blocking. The first error of the sink is
+// returned once, so a broken sink shows up without an error for every result.
+func (b *Buffered) Write(result Result) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		b.dropped.Add(1)
+		return nil
+	}
+	select {
+	case b.results <- result:
+	default:
+		b.dropped.Add(1)
+	}
+	if b.failed.Load() && b.reported.CompareAndSwap(false, true) {
+		return b.err
+	}
+	return nil
+}
+
+// Dropped is the number of results that did not fit into the buffer
+func (b *Buffered) Dropped() int64 {
+	return b.dropped.Load()
+}
+
+// Close writes the buffered results and closes the sink. Results written after Close are dropped.
+func (b *Buffered) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.results)
+	b.mu.Unlock()
+
+	<-b.done
+	err := b.sink.Close()
+	if b.failed.Load() {
+		return b.err
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvHeader names the columns of the CSV sink, durations are in nanoseconds
+var csvHeader = []string{
+	"target", "intended", "sent", "status",
+	"ttfb_ns", "total_ns", "dns_ns", "connect_ns", "tls_ns",
+	"cold", "event_id", "error_class", "error", "phase",
+	"experiment", "scenario", "params", "protocol", "grpc_status",
+	"outcome", "error_kind", "probe_outcome", "pods_before", "pods_after", "waited_ns",
+}
+
+var _ Sink = &csvSink{}
+
+// csvSink writes one row per result. It is not safe for concurrent use, see Buffered.
+type csvSink struct {
+	file   *RotatingFile
+	buf    *bufio.Writer
+	writer *csv.Writer
+}
+
+// NewCSVSink writes to path. Only the first segment of a rotated file has the
+// header, so the segments read back in order form one CSV file.
+func NewCSVSink(path string, rotation Rotation) (Sink, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := OpenRotating(path, rotation)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(file)
+	writer := csv.NewWriter(buf)
+	if err := writer.Write(csvHeader); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &csvSink{file: file, buf: buf, writer: writer}, nil
+}
+
+func (s *csvSink) Write(r Result) error {
+	// The probe columns are empty for other requests
+	probe := make([]string, 4)
+	if p := r.Probe; p != nil {
+		probe = []string{p.Outcome, strconv.Itoa(p.PodsBefore), strconv.Itoa(p.PodsAfter), strconv.FormatInt(int64(p.Waited), 10)}
+	}
+	return s.writer.Write(append([]string{
+		r.Target,
+		r.Intended.UTC().Format(time.RFC3339Nano),
+		r.Sent.UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(r.Status),
+		strconv.FormatInt(int64(r.TTFB), 10),
+		strconv.FormatInt(int64(r.Total), 10),
+		strconv.FormatInt(int64(r.DNS), 10),
+		strconv.FormatInt(int64(r.Connect), 10),
+		strconv.FormatInt(int64(r.TLS), 10),
+		strconv.FormatBool(r.Cold),
+		r.EventID,
+		r.ErrorClass,
+		r.Error,
+		r.Phase,
+		r.Experiment,
+		r.Scenario,
+		formatParams(r.Params),
+		r.Protocol,
+		r.GRPCStatus,
+		r.Outcome,
+		r.ErrorKind,
+	}, probe...))
+}
+
+// formatParams writes params as name=value pairs separated by semicolons, sorted by name
+func formatParams(params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + params[name]
+	}
+	return strings.Join(pairs, ";")
+}
+
+func (s *csvSink) Close() error {
+	s.writer.Flush()
+	if err := s.writer.Error(); err != nil {
+		s.file.Close()
+		return err
+	}
+	if err := s.buf.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// ReadCSVResults calls fn for every result in a file written by the CSV sink.
+// Columns are found by the header, so files from before a column was added
+// read as well. Use OpenSegments to read a rotated file.
+func ReadCSVResults(r io.Reader, fn func(Result) error) error {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	column := make(map[string]int, len(header))
+	for i, name := range header {
+		column[name] = i
+	}
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		result, err := parseCSVRow(row, column)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(result); err != nil {
+			return err
+		}
+	}
+}
+
+// parseCSVRow reads a row of the CSV sink, column holds the index of each column of the file
+func parseCSVRow(row []string, column map[string]int) (Result, error) {
+	var err error
+	get := func(name string) string {
+		if i, ok := column[name]; ok {
+			return row[i]
+		}
+		return ""
+	}
+	parseTime := func(name string) time.Time {
+		s := get(name)
+		if s == "" || err != nil {
+			return time.Time{}
+		}
+		t, e := time.Parse(time.RFC3339Nano, s)
+		if e != nil {
+			err = fmt.Errorf("%s: %w", name, e)
+		}
+		return t
+	}
+	parseInt := func(name string) int64 {
+		s := get(name)
+		if s == "" || err != nil {
+			return 0
+		}
+		n, e := strconv.ParseInt(s, 10, 64)
+		if e != nil {
+			err = fmt.Errorf("%s: %w", name, e)
+		}
+		return n
+	}
+
+	r := Result{
+		Target:     get("target"),
+		Intended:   parseTime("intended"),
+		Sent:       parseTime("sent"),
+		Status:     int(parseInt("status")),
+		TTFB:       time.Duration(parseInt("ttfb_ns")),
+		Total:      time.Duration(parseInt("total_ns")),
+		DNS:        time.Duration(parseInt("dns_ns")),
+		Connect:    time.Duration(parseInt("connect_ns")),
+		TLS:        time.Duration(parseInt("tls_ns")),
+		Cold:       get("cold") == "true",
+		EventID:    get("event_id"),
+		ErrorClass: get("error_class"),
+		Error:      get("error"),
+		Phase:      get("phase"),
+		Experiment: get("experiment"),
+		Scenario:   get("scenario"),
+		Params:     parseParams(get("params")),
+		Protocol:   get("protocol"),
+		GRPCStatus: get("grpc_status"),
+		Outcome:    get("outcome"),
+		ErrorKind:  get("error_kind"),
+	}
+	if outcome := get("probe_outcome"); outcome != "" {
+		r.Probe = &Probe{
+			Outcome:    outcome,
+			PodsBefore: int(parseInt("pods_before")),
+			PodsAfter:  int(parseInt("pods_after")),
+			Waited:     time.Duration(parseInt("waited_ns")),
+		}
+	}
+	return r, err
+}
+
+// parseParams reads the params written by formatParams
+func parseParams(s string) map[string]string {
+	if s == "" {
+		return nil
+	}
+	params := make(map[string]string)
+	for _, pair := range strings.Split(s, ";") {
+		name, value, _ := strings.Cut(pair, "=")
+		params[name] = value
+	}
+	return params
+}
@@ -0,0 +1,49 @@
+package store
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+)
+
+// Experiment describes what a run measures. It is copied into the run
+// manifest and every result, so analysis never has to parse file names.
+type Experiment struct {
+	// Name is also the log file prefix unless -prefix is given
+	Name        string   `yaml:"name" json:"name,omitempty"`
+	Scenario    string   `yaml:"scenario" json:"scenario,omitempty"`
+	Description string   `yaml:"description" json:"description,omitempty"`
+	Tags        []string `yaml:"tags" json:"tags,omitempty"`
+	// Params are free-form dimensions of the run, e.g. language: go or triggers: 10
+	Params map[string]string `yaml:"params" json:"params,omitempty"`
+}
+
+// Prefix returns the log file prefix for the experiment, empty if it has no name or scenario
+func (e Experiment) Prefix() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return e.Scenario
+}
+
+// JoinTags stores tags in a single column
+func JoinTags(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
+// InsertParams stores the parameters of an experiment in the experiment_params table
+func InsertParams(db *sql.DB, experimentID int64, params map[string]string) error {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, err := db.Exec(`INSERT INTO experiment_params (experiment_id, name, value) VALUES (?, ?, ?)`,
+			experimentID, name, params[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
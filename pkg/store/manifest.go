@@ -0,0 +1,86 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// ManifestSuffix is added to the log file name, without .log, to name the manifest of a run
+const ManifestSuffix = ".run.json"
+
+// Manifest describes one run of the workload generator. It is written when the
+// run starts and again when it ends, logparser takes the experiment metadata from it.
+type Manifest struct {
+	RunID      string     `json:"runId"`
+	Experiment Experiment `json:"experiment"`
+	// Config is the resolved config, with the keys of the YAML file
+	Config  map[string]interface{} `json:"config"`
+	Flags   map[string]string      `json:"flags"`
+	Version string                 `json:"version"`
+	Commit  string                 `json:"commit,omitempty"`
+	Start   time.Time              `json:"start"`
+	// End is nil while the run is going or if it never finished
+	End      *time.Time        `json:"end,omitempty"`
+	Hostname string            `json:"hostname"`
+	KSink    string            `json:"kSink,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// ManifestPath returns the manifest of the run that logs to logPath
+func ManifestPath(logPath string) string {
+	return strings.TrimSuffix(logPath, ".log") + ManifestSuffix
+}
+
+// WriteManifest replaces the manifest at path, readers never see a partial file
+func WriteManifest(path string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadManifest reads the manifest at path
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// RateColumns returns the rate settings of the resolved config by their
+// experiments column, as logparser reads them from the log of older runs
+func (m *Manifest) RateColumns() map[string]interface{} {
+	columns := make(map[string]interface{})
+	rate, _ := m.Config["rate"].(map[string]interface{})
+	// A manifest read back from JSON has every number as a float64
+	switch rps := rate["requestsPerSecond"].(type) {
+	case float64:
+		columns["requests_per_second"] = int(rps)
+	case int:
+		columns["requests_per_second"] = rps
+	}
+	for key, column := range map[string]string{
+		"duration":            "duration",
+		"maxIdleConns":        "max_idle_conns",
+		"maxIdleConnsPerHost": "max_idle_conns_per_host",
+		"idleConnTimeout":     "idle_conn_timeout",
+		"timeout":             "timeout",
+	} {
+		if v, ok := rate[key]; ok {
+			columns[column] = v
+		}
+	}
+	return columns
+}
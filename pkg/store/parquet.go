@@ -0,0 +1,176 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetRow is the schema of the Parquet sink, durations are in nanoseconds
+type parquetRow struct {
+	Target     string            `parquet:"target,dict"`
+	Intended   int64             `parquet:"intended,timestamp(nanosecond)"`
+	Sent       int64             `parquet:"sent,timestamp(nanosecond)"`
+	Status     int32             `parquet:"status"`
+	TTFB       int64             `parquet:"ttfb_ns"`
+	Total      int64             `parquet:"total_ns"`
+	DNS        int64             `parquet:"dns_ns"`
+	Connect    int64             `parquet:"connect_ns"`
+	TLS        int64             `parquet:"tls_ns"`
+	Cold       bool              `parquet:"cold"`
+	EventID    string            `parquet:"event_id,optional"`
+	ErrorClass string            `parquet:"error_class,optional,dict"`
+	Error      string            `parquet:"error,optional"`
+	Phase      string            `parquet:"phase,dict"`
+	Experiment string            `parquet:"experiment,optional,dict"`
+	Scenario   string            `parquet:"scenario,optional,dict"`
+	Params     map[string]string `parquet:"params"`
+	Protocol   string            `parquet:"protocol,optional,dict"`
+	GRPCStatus string            `parquet:"grpc_status,optional,dict"`
+	Outcome    string            `parquet:"outcome,optional,dict"`
+	ErrorKind  string            `parquet:"error_kind,optional,dict"`
+	// The probe columns are null for other requests
+	ProbeOutcome *string `parquet:"probe_outcome,optional,dict"`
+	PodsBefore   *int32  `parquet:"pods_before,optional"`
+	PodsAfter    *int32  `parquet:"pods_after,optional"`
+	Waited       *int64  `parquet:"waited_ns,optional"`
+}
+
+// parquetRowGroup is the number of results per row group
+const parquetRowGroup = 100_000
+
+var _ Sink = &parquetSink{}
+
+// parquetSink writes the results as a zstd compressed Parquet file, which is
+// only readable once the sink is closed. It is not safe for concurrent use, see Buffered.
+type parquetSink struct {
+	file    *os.File
+	writer  *parquet.GenericWriter[parquetRow]
+	pending int
+}
+
+func NewParquetSink(path string) (Sink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer := parquet.NewGenericWriter[parquetRow](file, parquet.Compression(&parquet.Zstd))
+	return &parquetSink{file: file, writer: writer}, nil
+}
+
+func (s *parquetSink) Write(r Result) error {
+	row := parquetRow{
+		Target:     r.Target,
+		Intended:   r.Intended.UnixNano(),
+		Sent:       r.Sent.UnixNano(),
+		Status:     int32(r.Status),
+		TTFB:       int64(r.TTFB),
+		Total:      int64(r.Total),
+		DNS:        int64(r.DNS),
+		Connect:    int64(r.Connect),
+		TLS:        int64(r.TLS),
+		Cold:       r.Cold,
+		EventID:    r.EventID,
+		ErrorClass: r.ErrorClass,
+		Error:      r.Error,
+		Phase:      r.Phase,
+		Experiment: r.Experiment,
+		Scenario:   r.Scenario,
+		Params:     r.Params,
+		Protocol:   r.Protocol,
+		GRPCStatus: r.GRPCStatus,
+		Outcome:    r.Outcome,
+		ErrorKind:  r.ErrorKind,
+	}
+	if p := r.Probe; p != nil {
+		before, after, waited := int32(p.PodsBefore), int32(p.PodsAfter), int64(p.Waited)
+		row.ProbeOutcome, row.PodsBefore, row.PodsAfter, row.Waited = &p.Outcome, &before, &after, &waited
+	}
+	if _, err := s.writer.Write([]parquetRow{row}); err != nil {
+		return err
+	}
+	s.pending++
+	if s.pending >= parquetRowGroup {
+		s.pending = 0
+		return s.writer.Flush()
+	}
+	return nil
+}
+
+func (s *parquetSink) Close() error {
+	if err := s.writer.Close(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// ReadParquetResults calls fn for every result in a file written by the Parquet sink
+func ReadParquetResults(path string, fn func(Result) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := parquet.NewGenericReader[parquetRow](file)
+	defer reader.Close()
+
+	rows := make([]parquetRow, 1024)
+	for {
+		n, err := reader.Read(rows)
+		for _, row := range rows[:n] {
+			if err := fn(row.result()); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (row parquetRow) result() Result {
+	r := Result{
+		Target:     row.Target,
+		Intended:   time.Unix(0, row.Intended).UTC(),
+		Sent:       time.Unix(0, row.Sent).UTC(),
+		Status:     int(row.Status),
+		TTFB:       time.Duration(row.TTFB),
+		Total:      time.Duration(row.Total),
+		DNS:        time.Duration(row.DNS),
+		Connect:    time.Duration(row.Connect),
+		TLS:        time.Duration(row.TLS),
+		Cold:       row.Cold,
+		EventID:    row.EventID,
+		ErrorClass: row.ErrorClass,
+		Error:      row.Error,
+		Phase:      row.Phase,
+		Experiment: row.Experiment,
+		Scenario:   row.Scenario,
+		Protocol:   row.Protocol,
+		GRPCStatus: row.GRPCStatus,
+		Outcome:    row.Outcome,
+		ErrorKind:  row.ErrorKind,
+	}
+	if len(row.Params) > 0 {
+		r.Params = row.Params
+	}
+	if row.ProbeOutcome != nil {
+		r.Probe = &Probe{Outcome: *row.ProbeOutcome}
+		if row.PodsBefore != nil {
+			r.Probe.PodsBefore = int(*row.PodsBefore)
+		}
+		if row.PodsAfter != nil {
+			r.Probe.PodsAfter = int(*row.PodsAfter)
+		}
+		if row.Waited != nil {
+			r.Probe.Waited = time.Duration(*row.Waited)
+		}
+	}
+	return r
+}
@@ -0,0 +1,228 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Error classes of a Result
+const (
+	// ErrorRequest means the request failed without a response
+	ErrorRequest = "request"
+	// ErrorStatus means the response had a non-2xx status
+	ErrorStatus = "status"
+	// ErrorBody means the response body could not be read
+	ErrorBody = "body"
+	// ErrorAssertion means the response broke an expect rule of the target other than its status
+	ErrorAssertion = "assertion"
+)
+
+// Outcomes of a Result
+const (
+	OutcomeOK = "ok"
+	// OutcomeHTTPError is a response with a status the target does not expect
+	OutcomeHTTPError = "http_error"
+	// OutcomeAssertionFailed is a response with an expected status that broke another rule
+	OutcomeAssertionFailed = "assertion_failed"
+	// OutcomeTimeout is a request that timed out before the whole response was read
+	OutcomeTimeout = "timeout"
+	// OutcomeConnError is a request that failed without a response for any other reason
+	OutcomeConnError = "conn_error"
+	// OutcomeSkipped is a cold start probe that was not sent, its Probe says why
+	OutcomeSkipped = "skipped"
+)
+
+// Outcomes of a cold start Probe
+const (
+	ProbeSent = "probed"
+	// ProbeNotConfirmed means the target still had pods when the confirmation timed out
+	ProbeNotConfirmed = "scale-to-zero-timeout"
+	// ProbeReplicaError means the pods of the target could not be read
+	ProbeReplicaError = "replica-error"
+	// ProbeFailed is a probe that was sent but got no whole response
+	ProbeFailed = "request-error"
+)
+
+// Probe describes a cold start probe. A probe that was not sent has Intended
+// and Sent set to when it was given up.
+type Probe struct {
+	Outcome string `json:"outcome"`
+	// PodsBefore and PodsAfter are the ready pods of the target, -1 if they are not watched
+	PodsBefore int `json:"podsBefore"`
+	PodsAfter  int `json:"podsAfter"`
+	// Waited is how long the probe waited for the target to scale to zero
+	Waited time.Duration `json:"waitedNs"`
+}
+
+// Result is the record of one request. Durations are in nanoseconds.
+type Result struct {
+	Target   string        `json:"target"`
+	Intended time.Time     `json:"intended"`
+	Sent     time.Time     `json:"sent"`
+	Status   int           `json:"status"`
+	TTFB     time.Duration `json:"ttfbNs"`
+	Total    time.Duration `json:"totalNs"`
+	DNS      time.Duration `json:"dnsNs"`
+	Connect  time.Duration `json:"connectNs"`
+	TLS      time.Duration `json:"tlsNs"`
+	Cold     bool          `json:"cold"`
+	// EventID is set for CloudEvents
+	EventID string `json:"eventId,omitempty"`
+	// ErrorClass is empty for successful requests
+	ErrorClass string `json:"errorClass,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Phase      string `json:"phase"`
+	// Outcome classifies the result, see the Outcome constants
+	Outcome string `json:"outcome,omitempty"`
+	// ErrorKind says why a request or body read failed, e.g. dial_refused, see the connection.Kind constants
+	ErrorKind string `json:"errorKind,omitempty"`
+	// Protocol is the HTTP version of the response, e.g. HTTP/2.0
+	Protocol string `json:"protocol,omitempty"`
+	// GRPCStatus is the status code of grpc calls, e.g. Unavailable. Status has its HTTP equivalent.
+	GRPCStatus string `json:"grpcStatus,omitempty"`
+	// Probe is set for cold start probes
+	Probe *Probe `json:"probe,omitempty"`
+	// Experiment, Scenario and Params come from the experiment section of the config
+	Experiment string            `json:"experiment,omitempty"`
+	Scenario   string            `json:"scenario,omitempty"`
+	Params     map[string]string `json:"params,omitempty"`
+}
+
+// Sinks for Store.Sink
+const (
+	SinkJSONL   = "jsonl"
+	SinkCSV     = "csv"
+	SinkParquet = "parquet"
+	SinkSQLite  = "sqlite"
+)
+
+// Sink receives the results of a run. Only Buffered and the JSONL sink are safe for concurrent use.
+type Sink interface {
+	Write(result Result) error
+	Close() error
+}
+
+// NewSink opens the sink configured in s behind a buffer. base is the path of
+// the run's files without extension, file sinks add their own. The SQLite sink
+// writes to s.Path and records the run of m, with the base name as the scenario if its experiment has none.
+func NewSink(s Store, base string, m *Manifest) (*Buffered, error) {
+	var sink Sink
+	var err error
+	switch s.Sink {
+	case "", SinkJSONL:
+		sink, err = NewJSONLSink(base+".jsonl", s.Rotation)
+	case SinkCSV:
+		sink, err = NewCSVSink(base+".csv", s.Rotation)
+	case SinkParquet:
+		sink, err = NewParquetSink(base + ".parquet")
+	case SinkSQLite:
+		if s.Path == "" {
+			return nil, fmt.Errorf("the sqlite sink needs a path")
+		}
+		run := *m
+		if run.Experiment.Scenario == "" {
+			run.Experiment.Scenario = filepath.Base(base)
+		}
+		sink, err = NewSQLiteSink(s.Path, &run)
+	default:
+		return nil, fmt.Errorf("unknown result sink %q", s.Sink)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewBuffered(sink, s.Buffer), nil
+}
+
+var _ Sink = &jsonlSink{}
+
+// jsonlSink writes one JSON object per line
+type jsonlSink struct {
+	mu      sync.Mutex
+	file    *RotatingFile
+	buf     *bufio.Writer
+	encoder *json.Encoder
+}
+
+func NewJSONLSink(path string, rotation Rotation) (Sink, error) {
+	file, err := OpenRotating(path, rotation)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(file)
+	return &jsonlSink{file: file, buf: buf, encoder: json.NewEncoder(buf)}, nil
+}
+
+func (s *jsonlSink) Write(result Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.encoder.Encode(result)
+}
+
+func (s *jsonlSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// resultExtensions are the files of the file sinks, in the order ResultFile looks for them
+var resultExtensions = []string{".jsonl", ".csv", ".parquet"}
+
+// ResultFile returns the file a JSONL, CSV or Parquet sink wrote for base, the
+// path of a run's files without extension, or "" if there is none
+func ResultFile(base string) (string, error) {
+	for _, ext := range resultExtensions {
+		path := base + ext
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// ReadResultFile calls fn for every result in a file found by ResultFile,
+// with the reader of its extension. Rotated files are read in order.
+func ReadResultFile(path string, fn func(Result) error) error {
+	if filepath.Ext(path) == ".parquet" {
+		return ReadParquetResults(path, fn)
+	}
+	file, err := OpenSegments(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if filepath.Ext(path) == ".csv" {
+		return ReadCSVResults(file, fn)
+	}
+	return ReadResults(file, fn)
+}
+
+// ReadResults calls fn for every result in a JSONL file written by the JSONL sink.
+// Use OpenSegments to read a rotated file.
+func ReadResults(r io.Reader, fn func(Result) error) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var result Result
+		if err := decoder.Decode(&result); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(result); err != nil {
+			return err
+		}
+	}
+}
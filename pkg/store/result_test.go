@@ -0,0 +1,134 @@
+package store
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func testResults() []Result {
+	sent := time.Date(2024, 11, 5, 10, 30, 0, 123456789, time.UTC)
+	return []Result{
+		{
+			Target:     "http://hello.functions.example.com",
+			Intended:   sent.Add(-time.Millisecond),
+			Sent:       sent,
+			Status:     200,
+			TTFB:       3 * time.Millisecond,
+			Total:      5 * time.Millisecond,
+			DNS:        time.Millisecond,
+			Connect:    2 * time.Millisecond,
+			Phase:      "steady",
+			Outcome:    OutcomeOK,
+			Protocol:   "HTTP/2.0",
+			Experiment: "serving",
+			Scenario:   "scenario-1",
+			Params:     map[string]string{"language": "go", "rps": "100"},
+		},
+		{
+			Target:     "http://hello.functions.example.com",
+			Intended:   sent,
+			Sent:       sent,
+			Error:      "dial tcp: connection refused, \"quoted\"",
+			ErrorClass: ErrorRequest,
+			ErrorKind:  "dial_refused",
+			Outcome:    OutcomeConnError,
+			Phase:      "cold",
+			Cold:       true,
+			Probe:      &Probe{Outcome: ProbeFailed, PodsBefore: 0, PodsAfter: 1, Waited: 7 * time.Second},
+			Params:     map[string]string{"rps": "100"},
+		},
+	}
+}
+
+func TestReadResultFile(t *testing.T) {
+	sinks := map[string]func(path string) (Sink, error){
+		".jsonl":   func(path string) (Sink, error) { return NewJSONLSink(path, Rotation{}) },
+		".csv":     func(path string) (Sink, error) { return NewCSVSink(path, Rotation{}) },
+		".parquet": NewParquetSink,
+	}
+	for ext, newSink := range sinks {
+		t.Run(ext, func(t *testing.T) {
+			base := filepath.Join(t.TempDir(), "run")
+			sink, err := newSink(base + ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := testResults()
+			for _, r := range want {
+				if err := sink.Write(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			path, err := ResultFile(base)
+			if err != nil || path != base+ext {
+				t.Fatalf("found %q and %v, expected %s", path, err, base+ext)
+			}
+			var got []Result
+			if err := ReadResultFile(path, func(r Result) error {
+				got = append(got, r)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("read\n%+v\nexpected\n%+v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadCSVResultsWithoutNewColumns(t *testing.T) {
+	file := "target,intended,sent,status,ttfb_ns,total_ns,dns_ns,connect_ns,tls_ns,cold,event_id,error_class,error,phase,experiment,scenario,params\n" +
+		"http://hello.functions.example.com,2024-11-05T10:30:00Z,2024-11-05T10:30:00Z,200,3000000,5000000,0,0,0,false,,,,steady,,,\n"
+	var got []Result
+	if err := ReadCSVResults(strings.NewReader(file), func(r Result) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Status != 200 || got[0].Total != 5*time.Millisecond || got[0].Outcome != "" || got[0].Probe != nil {
+		t.Errorf("read %+v", got)
+	}
+}
+
+func TestResultFileMissing(t *testing.T) {
+	path, err := ResultFile(filepath.Join(t.TempDir(), "run"))
+	if path != "" || err != nil {
+		t.Errorf("found %q and %v for a run without results", path, err)
+	}
+}
+
+func TestReadParquetResultsWithoutNewColumns(t *testing.T) {
+	type oldRow struct {
+		Target string `parquet:"target,dict"`
+		Sent   int64  `parquet:"sent,timestamp(nanosecond)"`
+		Status int32  `parquet:"status"`
+		Total  int64  `parquet:"total_ns"`
+		Phase  string `parquet:"phase,dict"`
+	}
+	path := filepath.Join(t.TempDir(), "run.parquet")
+	sent := time.Date(2024, 11, 5, 10, 30, 0, 0, time.UTC)
+	if err := parquet.WriteFile(path, []oldRow{{Target: "http://hello.functions.example.com", Sent: sent.UnixNano(), Status: 200, Total: int64(5 * time.Millisecond), Phase: "steady"}}); err != nil {
+		t.Fatal(err)
+	}
+	var got []Result
+	if err := ReadParquetResults(path, func(r Result) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !got[0].Sent.Equal(sent) || got[0].Status != 200 || got[0].Total != 5*time.Millisecond || got[0].Probe != nil {
+		t.Errorf("read %+v", got)
+	}
+}
@@ -0,0 +1,323 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions of rotated segments
+const (
+	CompressNone = ""
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+// Rotation cuts a log or result file into segments once it reaches a size or
+// an age. Rotated segments are named <file>.1, <file>.2, ... in order, plus
+// .gz or .zst when compressed. The file itself always holds the newest segment.
+type Rotation struct {
+	MaxSizeMB int `yaml:"maxSizeMB"`
+	// Interval is a Go duration, e.g. 1h
+	Interval string `yaml:"interval"`
+	// Compress is gzip, zstd or empty to keep segments uncompressed
+	Compress string `yaml:"compress"`
+}
+
+func (r Rotation) extension() (string, error) {
+	switch r.Compress {
+	case CompressNone:
+		return "", nil
+	case CompressGzip:
+		return ".gz", nil
+	case CompressZstd:
+		return ".zst", nil
+	default:
+		return "", fmt.Errorf("unknown compression %q", r.Compress)
+	}
+}
+
+// RotatingFile is a file that rotates according to a Rotation. Segments are
+// only cut after a newline, so every segment holds whole lines.
+// It is safe for concurrent use.
+type RotatingFile struct {
+	mu        sync.Mutex
+	path      string
+	maxSize   int64
+	interval  time.Duration
+	compress  string
+	extension string
+
+	file    *os.File
+	size    int64
+	opened  time.Time
+	segment int
+
+	// compressing tracks rotated segments that are still being compressed
+	compressing sync.WaitGroup
+	errMu       sync.Mutex
+	err         error
+}
+
+// OpenRotating opens path for appending, rotating it according to r
+func OpenRotating(path string, r Rotation) (*RotatingFile, error) {
+	extension, err := r.extension()
+	if err != nil {
+		return nil, err
+	}
+	var interval time.Duration
+	if r.Interval != "" {
+		if interval, err = time.ParseDuration(r.Interval); err != nil {
+			return nil, fmt.Errorf("rotation interval: %w", err)
+		}
+	}
+	f := &RotatingFile{
+		path:      path,
+		maxSize:   int64(r.MaxSizeMB) << 20,
+		interval:  interval,
+		compress:  r.Compress,
+		extension: extension,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// Name returns the path of the file, which holds the newest segment
+func (f *RotatingFile) Name() string {
+	return f.path
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.due(len(p)) {
+		return f.write(p)
+	}
+	// Finish the current line in this segment and start the next one after it
+	cut := bytes.LastIndexByte(p, '\n') + 1
+	if cut == 0 && f.size > 0 {
+		return f.write(p)
+	}
+	n, err := f.write(p[:cut])
+	if err != nil {
+		return n, err
+	}
+	if err := f.rotate(); err != nil {
+		return n, err
+	}
+	m, err := f.write(p[cut:])
+	return n + m, err
+}
+
+func (f *RotatingFile) write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// due reports whether writing n more bytes should start a new segment
+func (f *RotatingFile) due(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+int64(n) > f.maxSize {
+		return true
+	}
+	return f.interval > 0 && time.Since(f.opened) >= f.interval
+}
+
+// rotate renames the current file to the next segment and reopens it, f.mu must be held
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.segment++
+	segment := f.path + "." + strconv.Itoa(f.segment)
+	if err := os.Rename(f.path, segment); err != nil {
+		return err
+	}
+	if f.compress != CompressNone {
+		f.compressing.Add(1)
+		go func() {
+			defer f.compressing.Done()
+			if err := compressFile(segment, segment+f.extension, f.compress); err != nil {
+				f.errMu.Lock()
+				f.err = errors.Join(f.err, err)
+				f.errMu.Unlock()
+			}
+		}()
+	}
+	return f.open()
+}
+
+// Sync commits the newest segment to disk
+func (f *RotatingFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Sync()
+}
+
+// Close closes the file and waits for rotated segments to be compressed
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	err := f.file.Close()
+	f.mu.Unlock()
+
+	f.compressing.Wait()
+	f.errMu.Lock()
+	defer f.errMu.Unlock()
+	return errors.Join(err, f.err)
+}
+
+// compressFile writes src compressed to dst and removes src
+func compressFile(src, dst, compression string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var w io.WriteCloser
+	switch compression {
+	case CompressGzip:
+		w = gzip.NewWriter(out)
+	case CompressZstd:
+		if w, err = zstd.NewWriter(out); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// OpenSegments reads every segment of a rotated file in order, as if it had never been rotated
+func OpenSegments(path string) (io.ReadCloser, error) {
+	segments, err := segmentsOf(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var readers []io.Reader
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	for _, segment := range append(segments, path) {
+		file, err := os.Open(segment)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		closers = append(closers, file)
+		switch filepath.Ext(segment) {
+		case ".gz":
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("%s: %w", segment, err)
+			}
+			closers = append(closers, gz)
+			readers = append(readers, gz)
+		case ".zst":
+			zr, err := zstd.NewReader(file)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("%s: %w", segment, err)
+			}
+			closers = append(closers, zr.IOReadCloser())
+			readers = append(readers, zr)
+		default:
+			readers = append(readers, file)
+		}
+	}
+	return &segmentReader{Reader: io.MultiReader(readers...), closers: closers}, nil
+}
+
+// segmentsOf returns the rotated segments of path sorted by number. A segment
+// that exists both compressed and not is still being compressed, the
+// uncompressed one is used.
+func segmentsOf(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	byNumber := make(map[int]string)
+	for _, match := range matches {
+		rest := strings.TrimPrefix(match, path+".")
+		number, extension, _ := strings.Cut(rest, ".")
+		n, err := strconv.Atoi(number)
+		if err != nil || (extension != "" && extension != "gz" && extension != "zst") {
+			continue
+		}
+		if existing, ok := byNumber[n]; !ok || filepath.Ext(existing) != "" && extension == "" {
+			byNumber[n] = match
+		}
+	}
+
+	numbers := make([]int, 0, len(byNumber))
+	for n := range byNumber {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	segments := make([]string, len(numbers))
+	for i, n := range numbers {
+		segments[i] = byNumber[n]
+	}
+	return segments, nil
+}
+
+type segmentReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *segmentReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		err = errors.Join(err, c.Close())
+	}
+	return err
+}
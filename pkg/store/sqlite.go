@@ -0,0 +1,265 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteSchema is the schema of the results database, shared by logparser and the SQLite sink
+const SQLiteSchema = `
+	CREATE TABLE IF NOT EXISTS experiments (
+		id INTEGER PRIMARY KEY,
+		timestamp DATETIME NOT NULL,
+		language TEXT NOT NULL,
+		scenario TEXT NOT NULL,
+		concurrency INTEGER,
+		rps INTEGER,
+		requests_per_second INTEGER,
+		duration TEXT,
+		max_idle_conns INTEGER,
+		max_idle_conns_per_host INTEGER,
+		idle_conn_timeout TEXT,
+		timeout TEXT,
+		triggers INTEGER,
+		workers INTEGER,
+		run_id TEXT,
+		name TEXT,
+		description TEXT,
+		tags TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS experiment_params (
+		id INTEGER PRIMARY KEY,
+		experiment_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		FOREIGN KEY(experiment_id) REFERENCES experiments(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS requests (
+		id INTEGER PRIMARY KEY,
+		experiment_id INTEGER NOT NULL,
+		timestamp DATETIME NOT NULL,
+		status INTEGER NOT NULL,
+		ttfb REAL NOT NULL,
+		total_time REAL NOT NULL,
+		is_cold BOOLEAN NOT NULL,
+		dns_time REAL NOT NULL,
+		connect_time REAL NOT NULL,
+		tls_time REAL NOT NULL,
+		error_message TEXT,
+		event_id TEXT,
+		target TEXT,
+		intended_time DATETIME,
+		send_time DATETIME,
+		phase TEXT,
+		error_class TEXT,
+		protocol TEXT,
+		grpc_status TEXT,
+		outcome TEXT,
+		error_kind TEXT,
+		probe_outcome TEXT,
+		pods_before INTEGER,
+		pods_after INTEGER,
+		probe_wait_time REAL,
+		FOREIGN KEY(experiment_id) REFERENCES experiments(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS latency_percentiles (
+		id INTEGER PRIMARY KEY,
+		experiment_id INTEGER NOT NULL,
+		target TEXT NOT NULL,
+		metric TEXT NOT NULL,
+		percentile REAL NOT NULL,
+		value REAL NOT NULL,
+		count INTEGER NOT NULL,
+		FOREIGN KEY(experiment_id) REFERENCES experiments(id)
+	);
+`
+
+// addedColumns were added to SQLiteSchema after the first databases were created
+var addedColumns = []struct{ table, column, definition string }{
+	{"requests", "intended_time", "DATETIME"},
+	{"requests", "send_time", "DATETIME"},
+	{"requests", "phase", "TEXT"},
+	{"requests", "error_class", "TEXT"},
+	{"experiments", "run_id", "TEXT"},
+	{"experiments", "name", "TEXT"},
+	{"experiments", "description", "TEXT"},
+	{"experiments", "tags", "TEXT"},
+	{"requests", "protocol", "TEXT"},
+	{"requests", "grpc_status", "TEXT"},
+	{"requests", "outcome", "TEXT"},
+	{"requests", "error_kind", "TEXT"},
+	{"requests", "probe_outcome", "TEXT"},
+	{"requests", "pods_before", "INTEGER"},
+	{"requests", "pods_after", "INTEGER"},
+	{"requests", "probe_wait_time", "REAL"},
+}
+
+// InitSQLite creates the tables of SQLiteSchema and adds the columns that
+// databases created with an older schema are missing
+func InitSQLite(db *sql.DB) error {
+	if _, err := db.Exec(SQLiteSchema); err != nil {
+		return err
+	}
+	for _, c := range addedColumns {
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteBatch is the number of results committed in one transaction
+const sqliteBatch = 1000
+
+var _ Sink = &sqliteSink{}
+
+// sqliteSink inserts results into the requests table, under an experiment row
+// it creates for the run. It is not safe for concurrent use, see Buffered.
+type sqliteSink struct {
+	db           *sql.DB
+	tx           *sql.Tx
+	stmt         *sql.Stmt
+	pending      int
+	experimentID int64
+}
+
+// NewSQLiteSink opens or creates the database at path and adds an experiment
+// row for the run of m, with its run ID, rate settings and the metadata and parameters of its experiment
+func NewSQLiteSink(path string, m *Manifest) (Sink, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := InitSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	exp, rate := m.Experiment, m.RateColumns()
+	res, err := db.Exec(`
+		INSERT INTO experiments (
+			timestamp, language, scenario, requests_per_second, duration, max_idle_conns,
+			max_idle_conns_per_host, idle_conn_timeout, timeout, run_id, name, description, tags
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.Start.UTC().Format(time.RFC3339), exp.Params["language"], exp.Scenario,
+		rate["requests_per_second"], rate["duration"], rate["max_idle_conns"],
+		rate["max_idle_conns_per_host"], rate["idle_conn_timeout"], rate["timeout"],
+		nullable(m.RunID), nullable(exp.Name), nullable(exp.Description), nullable(JoinTags(exp.Tags)))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := InsertParams(db, id, exp.Params); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteSink{db: db, experimentID: id}, nil
+}
+
+func (s *sqliteSink) Write(r Result) error {
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(`
+			INSERT INTO requests (
+				experiment_id, timestamp, status, ttfb, total_time,
+				is_cold, dns_time, connect_time, tls_time, error_message, event_id, target,
+				intended_time, send_time, phase, error_class, protocol, grpc_status, outcome, error_kind,
+				probe_outcome, pods_before, pods_after, probe_wait_time
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		s.tx, s.stmt = tx, stmt
+	}
+
+	_, err := s.stmt.Exec(append([]interface{}{
+		s.experimentID,
+		r.Sent.Add(r.Total).UTC().Format(time.RFC3339Nano),
+		r.Status,
+		milliseconds(r.TTFB),
+		milliseconds(r.Total),
+		r.Cold,
+		milliseconds(r.DNS),
+		milliseconds(r.Connect),
+		milliseconds(r.TLS),
+		r.Error,
+		nullable(r.EventID),
+		r.Target,
+		r.Intended.UTC().Format(time.RFC3339Nano),
+		r.Sent.UTC().Format(time.RFC3339Nano),
+		r.Phase,
+		nullable(r.ErrorClass),
+		nullable(r.Protocol),
+		nullable(r.GRPCStatus),
+		nullable(r.Outcome),
+		nullable(r.ErrorKind),
+	}, ProbeColumns(r.Probe)...)...)
+	if err != nil {
+		return err
+	}
+	s.pending++
+	if s.pending >= sqliteBatch {
+		return s.commit()
+	}
+	return nil
+}
+
+func (s *sqliteSink) commit() error {
+	if s.tx == nil {
+		return nil
+	}
+	s.stmt.Close()
+	err := s.tx.Commit()
+	s.tx, s.stmt, s.pending = nil, nil, 0
+	return err
+}
+
+func (s *sqliteSink) Close() error {
+	if err := s.commit(); err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
+
+// ProbeColumns returns the values of the probe columns of the requests table, NULL for requests that are not probes
+func ProbeColumns(p *Probe) []interface{} {
+	if p == nil {
+		return []interface{}{nil, nil, nil, nil}
+	}
+	return []interface{}{p.Outcome, p.PodsBefore, p.PodsAfter, milliseconds(p.Waited)}
+}
+
+// milliseconds is the unit of the durations in the requests table
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
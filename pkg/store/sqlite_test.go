@@ -0,0 +1,49 @@
+package store
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteSinkExperimentRow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "benchmark.db")
+	m := &Manifest{
+		RunID:      "run-1",
+		Experiment: Experiment{Name: "serving", Scenario: "scenario-1", Params: map[string]string{"language": "go"}},
+		Config: map[string]interface{}{"rate": map[string]interface{}{
+			"requestsPerSecond": 50,
+			"duration":          "1m0s",
+			"maxIdleConns":      100,
+			"timeout":           "5s",
+		}},
+		Start: time.Date(2024, 11, 5, 10, 30, 0, 0, time.UTC),
+	}
+	sink, err := NewSQLiteSink(path, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var timestamp, language, scenario, duration, timeout, runID string
+	var rps, maxIdleConns int
+	var idleConnTimeout sql.NullString
+	if err := db.QueryRow(`SELECT timestamp, language, scenario, requests_per_second, duration, max_idle_conns, idle_conn_timeout, timeout, run_id FROM experiments`).
+		Scan(&timestamp, &language, &scenario, &rps, &duration, &maxIdleConns, &idleConnTimeout, &timeout, &runID); err != nil {
+		t.Fatal(err)
+	}
+	if timestamp != "2024-11-05T10:30:00Z" || language != "go" || scenario != "scenario-1" || runID != "run-1" {
+		t.Errorf("experiment is %s %s %s %s", timestamp, language, scenario, runID)
+	}
+	if rps != 50 || duration != "1m0s" || maxIdleConns != 100 || idleConnTimeout.Valid || timeout != "5s" {
+		t.Errorf("rate is %d rps for %s, %d idle connections for %v and a timeout of %s", rps, duration, maxIdleConns, idleConnTimeout, timeout)
+	}
+}
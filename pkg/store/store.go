@@ -2,13 +2,20 @@ package store
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"time"
 )
 
 type Store struct {
 	LogDirPath string `yaml:"logDirPath"`
+	// Sink is where request results are written: jsonl (default), csv, parquet or sqlite
+	Sink string `yaml:"sink"`
+	// Path is the database of the sqlite sink
+	Path string `yaml:"path"`
+	// Buffer is the number of results held for the sink, results beyond it are dropped
+	Buffer int `yaml:"buffer"`
+	// Rotation applies to the log and to the jsonl and csv result files
+	Rotation Rotation `yaml:"rotation"`
 }
 
 func GetLogFilePath(prefix string, logDirPath string) string {
@@ -16,11 +23,11 @@ func GetLogFilePath(prefix string, logDirPath string) string {
 	return filepath.Join(logDirPath, fmt.Sprintf("%s_%s.log", prefix, now))
 }
 
-func GetLogFileWriter(prefix string, logDirPath string) *os.File {
-	filePath := GetLogFilePath(prefix, logDirPath)
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+// GetLogFileWriter opens a new log file in logDirPath, rotated according to rotation
+func GetLogFileWriter(prefix string, logDirPath string, rotation Rotation) (*RotatingFile, error) {
+	file, err := OpenRotating(GetLogFilePath(prefix, logDirPath), rotation)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to open log file: %v", err))
+		return nil, fmt.Errorf("failed to open log file: %w", err)
 	}
-	return file
+	return file, nil
 }